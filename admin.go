@@ -0,0 +1,47 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// adminAuth requires the admin token (--http.admin-token) to be supplied as
+// a bearer token in the Authorization header.
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(r.Header.Get("Authorization"))
+		if len(token) < 7 || !strings.EqualFold(token[:7], "bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token[7:])), []byte(flags.HTTP.AdminToken)) != 1 {
+			logger.Printf("unauthorized admin request from %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="geoip"`)
+			errorResponse(w, r, http.StatusUnauthorized, errCodeUnauthorized, "invalid or missing admin token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminReload reloads the database from disk, and returns the metadata of
+// the newly loaded database. If the reload fails, the previous database
+// continues to be used.
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	logger.Printf("database reload requested by %s", r.RemoteAddr)
+
+	if err := db.load(); err != nil {
+		logger.Printf("error reloading database %q (continuing to use previous): %s", displayPath(db.path), err)
+		errorResponse(w, r, http.StatusInternalServerError, errCodeInternal, "unable to reload database %q: %s", displayPath(db.path), err)
+		return
+	}
+
+	db.meta.RLock()
+	meta := db.meta.cache
+	db.meta.RUnlock()
+
+	jsonResponse(w, r, newMetaResult(meta))
+}
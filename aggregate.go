@@ -0,0 +1,114 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// aggregateUnknown is the bucket of addresses which are invalid, reserved,
+// or have no value for the grouping dimension.
+const aggregateUnknown = "unknown"
+
+// aggregation is a dimension which batch lookups can be grouped by, with
+// "?by=<name>".
+type aggregation struct {
+	// field is the result field the dimension is derived from, used as the
+	// lookup filter, so e.g. rdns isn't done.
+	field string
+	// include is the optional database required by the dimension, if any.
+	include string
+	key     func(result *AddrResult) string
+}
+
+var aggregations = map[string]*aggregation{
+	"country": {
+		field: "country_abbr",
+		key:   func(result *AddrResult) string { return result.CountryCode },
+	},
+	"continent": {
+		field: "continent_abbr",
+		key:   func(result *AddrResult) string { return result.ContinentCode },
+	},
+	"asn": {
+		field:   "autonomous_system_number",
+		include: "asn",
+		key: func(result *AddrResult) string {
+			if result.ASN == 0 {
+				return ""
+			}
+			return strconv.FormatUint(uint64(result.ASN), 10)
+		},
+	},
+}
+
+// apiAggregate looks up a batch of addresses (the same as a batch lookup),
+// returning only the number of addresses in each group of the requested
+// dimension (?by=country, the default, continent or asn), e.g.
+// {"US": 412, "DE": 88, "unknown": 3}.
+func apiAggregate(w http.ResponseWriter, r *http.Request) {
+	// Only the query string is used, as r.FormValue would consume the body
+	// of form encoded requests.
+	by := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("by")))
+	if by == "" {
+		by = "country"
+	}
+
+	agg, ok := aggregations[by]
+	if !ok {
+		names := make([]string, 0, len(aggregations))
+		for name := range aggregations {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "invalid grouping %q (must be one of: %s)", by, strings.Join(names, ", "))
+		return
+	}
+
+	if agg.include == "asn" && flags.ASNPath == "" {
+		errorResponse(w, r, http.StatusNotImplemented, errCodeNotImplemented, "asn database not configured")
+		return
+	}
+
+	addrs, ok := decodeAddrs(w, r)
+	if !ok {
+		return
+	}
+
+	if len(addrs) > flags.HTTP.BatchMax {
+		errorResponse(w, r, http.StatusRequestEntityTooLarge, errCodeTooLarge, "too many addresses supplied (max: %d)", flags.HTTP.BatchMax)
+		return
+	}
+
+	// The rate limiter has already counted this request once, so count the
+	// remaining addresses against the limit as well.
+	if len(addrs) > 1 && !hitLimit(w, r, uint64(len(addrs)-1)) {
+		return
+	}
+
+	opts := newLookupOptions(w, r)
+	opts.filters = []string{agg.field}
+	if agg.include != "" {
+		opts.include = []string{agg.include}
+	}
+
+	counts := make(map[string]int)
+	for _, result := range lookupBatch(r.Context(), addrs, opts) {
+		key := aggregateUnknown
+		if result.IP != nil && result.Error == "" {
+			if k := agg.key(result); k != "" {
+				key = k
+			}
+		}
+
+		counts[key]++
+	}
+
+	jsonResponse(w, r, counts)
+}
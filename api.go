@@ -5,21 +5,109 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/bluele/gcache"
 	"github.com/go-chi/chi"
-	bogon "github.com/lrstanley/go-bogon"
+	"github.com/go-chi/chi/middleware"
+	"github.com/lrstanley/geoip/geoip"
+	maxminddb "github.com/oschwald/maxminddb-golang"
 )
 
 func registerAPI(r chi.Router) {
-	r.Get("/api/{addr}", apiLookup)
-	r.Get("/api/{addr}/{filters}", apiLookup)
+	// Batch lookups are throttled separately, so they can't starve single
+	// lookups.
+	r.Group(func(r chi.Router) {
+		r.Use(throttle(flags.HTTP.Throttle), limitConcurrency)
+
+		r.Get("/api/self", apiSelfLookup)
+		r.Get("/api/distance", apiDistance)
+		r.Get("/api/{addr}", apiLookup)
+		r.Get("/api/{addr}/{filters}", apiLookup)
+		r.Get("/api/lookup/*", apiNetworkLookup)
+		r.Get("/api/resolver/{addr}", apiResolverLookup)
+		r.Get("/api/country/{iso}/subdivisions", apiCountrySubdivisions)
+		r.Get("/api/asn/{addr}", apiASNLookup)
+		r.Get("/api/anonymous/{addr}", apiAnonymousLookup)
+		r.Get("/api/isp/{addr}", apiISPLookup)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(throttle(flags.HTTP.ThrottleBatch), limitConcurrency)
+
+		r.Post("/api/lookup/batch", apiBatchLookup)
+		r.Get("/api/lookup", apiQueryLookup)
+		r.Post("/api/aggregate", apiAggregate)
+	})
+
+	// Websocket connections are long-lived, so aren't throttled (they have
+	// their own limit, --http.ws-max-conns).
+	if flags.HTTP.WSMaxConns > 0 {
+		r.Get("/api/self/ws", apiSelfWebsocket)
+	}
+}
+
+// maxBodySize limits the size of request bodies to limit bytes. Reading past
+// the limit returns a *http.MaxBytesError. A limit of 0 disables the limit.
+func maxBodySize(limit int64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// throttle limits the number of concurrently processed requests to limit,
+// queuing up to the same amount again for up to --http.throttle-timeout. A
+// limit of 0 disables throttling.
+func throttle(limit int) func(next http.Handler) http.Handler {
+	if limit <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+
+	return middleware.ThrottleBacklog(limit, limit*2, flags.HTTP.ThrottleTimeout)
+}
+
+// lookupSlots bounds the number of concurrently processed lookup requests
+// (see --http.max-concurrency). nil if unlimited.
+var lookupSlots chan struct{}
+
+// limitConcurrency rejects requests with a 503 when --http.max-concurrency
+// lookup requests are already being processed. Unlike throttle, requests are
+// never queued, so a burst of requests can't pile up goroutines (and memory)
+// in the lookup and enrichment pipeline.
+func limitConcurrency(next http.Handler) http.Handler {
+	if lookupSlots == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case lookupSlots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			errorResponse(w, r, http.StatusServiceUnavailable, errCodeOverloaded, "too many concurrent lookups, try again later")
+			return
+		}
+		defer func() { <-lookupSlots }()
+
+		next.ServeHTTP(w, r)
+	})
 }
 
 func apiLookup(w http.ResponseWriter, r *http.Request) {
@@ -30,8 +118,7 @@ func apiLookup(w http.ResponseWriter, r *http.Request) {
 	// unwanted extra memory usage/be considered a resource usage attack),
 	// we shouldn't handle their request.
 	if len(filters) > 20 {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "error: too many filters supplied")
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "too many filters supplied")
 		return
 	}
 
@@ -43,81 +130,854 @@ func apiLookup(w http.ResponseWriter, r *http.Request) {
 	// their own IP address. Note that this will not work if you are querying
 	// the IP address locally.
 	if self := strings.ToLower(addr); self == "self" || self == "me" {
-		if strings.Contains(r.RemoteAddr, ":") {
-			addr, _, _ = net.SplitHostPort(r.RemoteAddr)
-		} else {
-			addr = r.RemoteAddr
+		addr = clientIP(r)
+		privateResponse(r)
+	}
+
+	serveLookup(w, r, addr, filters)
+}
+
+// apiSelfLookup geolocates the client making the request. When running
+// behind a proxy (--http.proxy), r.RemoteAddr has already been replaced by
+// the RealIP middleware with the address the proxy supplied.
+//
+// A specific hop of the X-Forwarded-For chain may be selected with "hop"
+// (e.g. "/api/self?hop=1"), which is validated against the trusted proxies.
+func apiSelfLookup(w http.ResponseWriter, r *http.Request) {
+	privateResponse(r)
+	addr := clientIP(r)
+
+	if hop := strings.TrimSpace(r.FormValue("hop")); hop != "" {
+		ip, err := forwardedHop(r, hop)
+		if err != nil {
+			errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "%s", err)
+			return
+		}
+
+		addr = ip.String()
+	}
+
+	serveLookup(w, r, addr, []string{})
+}
+
+// apiNetworkLookup looks up either a single address, or if a CIDR (e.g.
+// "/api/lookup/203.0.113.0/24") or an inclusive range (e.g.
+// "/api/lookup/203.0.113.10-203.0.113.50") is provided, the distinct network
+// blocks within it.
+func apiNetworkLookup(w http.ResponseWriter, r *http.Request) {
+	addr := strings.TrimSpace(chi.URLParam(r, "*"))
+
+	var networks []*net.IPNet
+	var err error
+
+	if start, _, ok := strings.Cut(addr, "-"); ok && net.ParseIP(strings.TrimSpace(start)) != nil {
+		networks, err = parseRange(addr, flags.HTTP.RangeMax)
+		if err != nil {
+			errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "%s", err)
+			return
+		}
+	} else if strings.Contains(addr, "/") {
+		var network *net.IPNet
+
+		_, network, err = net.ParseCIDR(addr)
+		if err != nil {
+			errorResponse(w, r, http.StatusBadRequest, errCodeInvalidIP, "invalid cidr specified: %s", addr)
+			return
+		}
+
+		ones, _ := network.Mask.Size()
+		maxPrefix := flags.HTTP.CIDRMaxV6
+		if network.IP.To4() != nil {
+			maxPrefix = flags.HTTP.CIDRMaxV4
+		}
+
+		if ones < maxPrefix {
+			errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "cidr too wide (must be /%d or narrower)", maxPrefix)
+			return
+		}
+
+		networks = []*net.IPNet{network}
+	} else {
+		serveLookup(w, r, addr, []string{})
+		return
+	}
+
+	if !allowPrivate(r) {
+		for _, network := range networks {
+			if reservedAddr(network.IP) {
+				errorResponse(w, r, http.StatusUnprocessableEntity, errCodeReservedRange, "%s: %s", errReservedAddr, addr)
+				return
+			}
+		}
+	}
+
+	fields, err := parseFields(r, []AddrResult{})
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "%s", err)
+		return
+	}
+
+	lang := negotiateLanguage(w, r)
+	results := []*AddrResult{}
+	var truncated bool
+
+	// Multiple networks of a range may fall within the same database network
+	// block, so only return each block once.
+	seen := make(map[string]bool)
+
+	for _, network := range networks {
+		found, more, lerr := networkLookup(network, flags.HTTP.CIDRMaxResults-len(results), lang)
+		if errors.Is(lerr, geoip.ErrUnsupported) {
+			errorResponse(w, r, http.StatusNotImplemented, errCodeNotImplemented, "network lookups are %s", lerr)
+			return
+		}
+
+		if lerr != nil {
+			logger.Printf("error looking up network %q: %s", network, lerr)
+			errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "unable to query database")
+			return
+		}
+
+		for _, result := range found {
+			if !seen[*result.Network] {
+				seen[*result.Network] = true
+				results = append(results, result)
+			}
+		}
+
+		truncated = truncated || more
+	}
+
+	if truncated {
+		w.Header().Set("X-Results-Truncated", "true")
+	}
+
+	if responseFormat(r) == formatCSV {
+		csvResponse(w, r, results, nil, "geoip-network.csv")
+		return
+	}
+
+	if len(fields) > 0 {
+		var filtered interface{}
+
+		filtered, err = geoip.SelectFields(results, fields)
+		if err != nil {
+			panic(err)
+		}
+
+		jsonResponse(w, r, styleFields(filtered))
+		return
+	}
+
+	jsonResponse(w, r, styleFields(results))
+}
+
+// clientIP returns the IP address of the client, without the port.
+func clientIP(r *http.Request) string {
+	if strings.Contains(r.RemoteAddr, ":") {
+		addr, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err == nil {
+			return addr
+		}
+	}
+
+	return r.RemoteAddr
+}
+
+func serveLookup(w http.ResponseWriter, r *http.Request, addr string, filters []string) {
+	format := responseFormat(r)
+
+	fields, err := parseFields(r, AddrResult{})
+	if err == nil && len(fields) > 0 && format == formatXML {
+		err = errors.New("field selection is not supported with xml output")
+	}
+
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "%s", err)
+		return
+	}
+
+	// A single field may also be requested for plain text responses.
+	if len(fields) == 0 && format == formatText {
+		if field := strings.TrimSpace(r.FormValue("field")); field != "" {
+			fields = []string{field}
 		}
 	}
 
-	// This would be the index key used for arc cache, if they request custom
-	// filters, we should add that to the key, because those filters may
-	// mean that the returned lookup has excluded information, which may
+	// Field selections are passed along with the filters, so enrichment the
+	// user didn't ask for can be skipped, and so the cache key differs
+	// between selections.
+	lookupFilters := filters
+	if len(lookupFilters) == 0 {
+		lookupFilters = topLevelFields(fields)
+	}
+
+	opts := newLookupOptions(w, r)
+	opts.filters = lookupFilters
+
+	result, cache, err := lookupAddr(r.Context(), addr, opts)
+	if err != nil {
+		errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "unable to query database")
+		return
+	}
+
+	w.Header().Set("X-Cache", cache)
+
+	if result.status != 0 {
+		errorResponse(w, r, result.status, result.code, "%s", result.Error)
+		return
+	}
+
+	// Addresses without a database record are returned as a 404, so they can
+	// be distinguished from an empty (but found) result.
+	if result.IP != nil && result.Error != "" && (format == formatJSON || format == formatXML) {
+		errorResponse(w, r, http.StatusNotFound, errCodeNotFound, "no results found for %s", result.IP)
+		return
+	}
+
+	if ok, _ := strconv.ParseBool(r.FormValue("dualstack")); ok && !lookupFamilies(w, r, result, opts) {
+		return
+	}
+
+	apiResponse(w, r, result, filters, fields)
+}
+
+// lookupFamilies geolocates the first ipv4 and the first ipv6 address of the
+// hostname of result, if it resolved to both. The additional lookup is counted
+// against the rate limit. false is returned if an error has been written to
+// the client.
+func lookupFamilies(w http.ResponseWriter, r *http.Request, result *AddrResult, opts lookupOptions) bool {
+	var v4, v6 string
+	for i := 0; i < len(result.Addresses); i++ {
+		if net.ParseIP(result.Addresses[i]).To4() != nil {
+			if v4 == "" {
+				v4 = result.Addresses[i]
+			}
+		} else if v6 == "" {
+			v6 = result.Addresses[i]
+		}
+	}
+
+	if v4 == "" || v6 == "" {
+		return true
+	}
+
+	// One of the addresses is the address of the result itself, so only one
+	// lookup is added.
+	if !hitLimit(w, r, 1) {
+		return false
+	}
+
+	for addr, family := range map[string]**familyResult{v4: &result.IPv4, v6: &result.IPv6} {
+		found, _, err := lookupAddr(r.Context(), addr, opts)
+		if err != nil {
+			errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "unable to query database")
+			return false
+		}
+
+		*family = &familyResult{found}
+	}
+
+	return true
+}
+
+// lookupOptions are the options of a lookup which affect its result, and
+// as such, are also part of the cache key.
+type lookupOptions struct {
+	// filters are the requested fields (if any), so enrichment the user
+	// didn't ask for can be skipped.
+	filters []string
+	// lang is the language to return names in.
+	lang string
+	// allowPrivate allows private/reserved addresses to be looked up.
+	allowPrivate bool
+	// include are the optional databases to merge into the result.
+	include []string
+	// rdns populates the hostname field with the reverse dns hostname of the
+	// address ("?rdns=true").
+	rdns bool
+}
+
+// newLookupOptions returns the lookup options requested by the client. The
+// filters must be set by the caller.
+func newLookupOptions(w http.ResponseWriter, r *http.Request) lookupOptions {
+	return lookupOptions{
+		lang:         negotiateLanguage(w, r),
+		allowPrivate: allowPrivate(r),
+		include:      parseInclude(r),
+		rdns:         wantsRDNS(r),
+	}
+}
+
+// wantsRDNS returns true if the client requested a reverse dns lookup, with
+// "?rdns=true". Only the query string is used, as this is also used for
+// batch lookups, whose body must not be consumed.
+func wantsRDNS(r *http.Request) bool {
+	ok, _ := strconv.ParseBool(r.URL.Query().Get("rdns"))
+	return ok
+}
+
+// lookupAddr resolves addr (an IP or hostname) and returns the geoip result,
+// fetching from (and populating) the lookup cache where possible. Invalid or
+// internal addresses are returned as results with the Error field set, and
+// err is only returned when the database itself could not be queried. cache
+// is the status of the lookup against the lookup cache (e.g. cacheHit).
+func lookupAddr(ctx context.Context, addr string, opts lookupOptions) (result *AddrResult, cache string, err error) {
+	started := time.Now()
+	defer func() {
+		traceLookup(ctx, addr, cache == cacheHit)
+
+		switch {
+		case err != nil:
+			observeLookup(started, statusError)
+		case result.IP == nil:
+			observeLookup(started, statusInvalid)
+		case result.Error != "":
+			observeLookup(started, statusNotFound)
+		default:
+			observeLookup(started, statusSuccess)
+			publishLookup(result)
+		}
+	}()
+
+	addr = normalizeAddr(addr)
+
+	// This would be the index key used for the lookup cache, if they request
+	// custom filters, we should add that to the key, because those filters
+	// may mean that the returned lookup has excluded information, which may
 	// cause issues if the same query is returned with no requested filters.
-	key := addr
-	if len(filters) > 0 {
-		key = addr + ":" + strings.Join(filters, ",")
+	// The key is also scoped to the language and loaded database, so results
+	// in other languages, or from an older database, aren't returned.
+	key := opts.lang + ":" + addr
+	if len(opts.filters) > 0 {
+		key += ":" + strings.Join(opts.filters, ",")
+	}
+	if len(opts.include) > 0 {
+		key += ":include=" + strings.Join(opts.include, ",")
+	}
+	if opts.allowPrivate {
+		key += ":private"
 	}
+	if opts.rdns {
+		key += ":rdns"
+	}
+
+	mcache.RLock()
+	if mcache.cache != nil {
+		key = fmt.Sprintf("%s:%d:%s", mcache.cache.DatabaseType, mcache.cache.BuildEpoch, key)
+	}
+	mcache.RUnlock()
 
-	var result *AddrResult
+	cache = cacheMiss
 
-	query, err := arc.GetIFPresent(key)
+	cacheStarted := time.Now()
+	cachedResult, err := lookupCache.Get(key)
+	addTiming(ctx, "cache", cacheStarted)
 	if err == nil {
-		resultFromARC, _ := query.(AddrResult)
-		result = &resultFromARC
-		w.Header().Set("X-Cache", "HIT")
-		logger.Printf("query %s fetched from arc cache", addr)
+		metricCacheLookups.WithLabelValues("hit").Inc()
+		logger.Printf("query %s fetched from lookup cache", addr)
+		return cachedResult, cacheHit, nil
+	}
 
-		apiResponse(w, r, result, filters)
-		return
+	metricCacheLookups.WithLabelValues("miss").Inc()
+	if err != errCacheMiss {
+		// Continue with the lookup if the cache is unavailable.
+		logger.Printf("unable to get %s from lookup cache: %s", addr, err)
+		cache = cacheBypass
+	}
+
+	ip, addrs, err := parseAddr(ctx, addr, opts.allowPrivate)
+	if err != nil {
+		result = &AddrResult{Error: err.Error()}
+		if result.status, result.code = addrError(err); result.status != 0 {
+			result.Reason = result.code.reason()
+		}
+
+		return result, cache, nil
+	}
+
+	result, err = addrLookup(ctx, ip, opts)
+	if err != nil {
+		logger.Printf("error looking up address %q (%q): %s", addr, ip, err)
+		return nil, cache, err
+	}
+
+	for i := 0; i < len(addrs); i++ {
+		result.Addresses = append(result.Addresses, addrs[i].String())
+	}
+
+	if cache == cacheMiss {
+		cacheStarted = time.Now()
+		if err = lookupCache.Set(key, result); err != nil {
+			logger.Printf("unable to add %s to lookup cache: %s", addr, err)
+		}
+		addTiming(ctx, "cache", cacheStarted)
+	}
+
+	return result, cache, nil
+}
+
+// addrError returns the status and error code of an error returned by
+// parseAddr. status is 0 if the error is unknown.
+func addrError(err error) (status int, code errorCode) {
+	var rerr *resolveError
+
+	switch {
+	case errors.As(err, &rerr):
+		return http.StatusUnprocessableEntity, errCodeUnresolvable
+	case errors.Is(err, errReservedAddr):
+		return http.StatusUnprocessableEntity, errCodeReservedRange
+	case errors.Is(err, errHostnameDisabled):
+		return http.StatusBadRequest, errCodeHostnameDisabled
+	case errors.Is(err, errInvalidAddr):
+		return http.StatusBadRequest, errCodeInvalidIP
+	}
+
+	return 0, 0
+}
+
+// addrErrorResponse writes the error returned by parseAddr to the client.
+func addrErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := addrError(err)
+	if status == 0 {
+		status, code = http.StatusBadRequest, errCodeInvalidRequest
+	}
+
+	errorResponse(w, r, status, code, "%s", err)
+}
+
+// errHostnameDisabled is returned when a hostname is looked up, and hostname
+// lookups have been disabled.
+var errHostnameDisabled = errors.New("hostname lookups are disabled")
+
+// errReservedAddr is returned when an address is within a private or
+// reserved range, which has no geoip data.
+var errReservedAddr = errors.New("internal address")
+
+// allowPrivate returns true if the client requested that private/reserved
+// addresses be looked up anyway, with "?allow_private=true".
+func allowPrivate(r *http.Request) bool {
+	ok, _ := strconv.ParseBool(r.FormValue("allow_private"))
+	return ok
+}
+
+// errInvalidAddr is returned when an address looks like an IP address (e.g.
+// it contains a colon, which isn't valid in hostnames), but doesn't parse as
+// one.
+var errInvalidAddr = errors.New("invalid ip address")
+
+// normalizeAddr returns the canonical form of addr, if it's an IP address, so
+// that the different forms of the same IPv6 address (e.g. bracketed, with a
+// zone, expanded, or uppercase) are treated the same. Hostnames are returned
+// as-is.
+func normalizeAddr(addr string) string {
+	addr = strings.TrimSpace(addr)
+
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[1 : len(addr)-1]
 	}
 
-	w.Header().Set("X-Cache", "MISS")
-	if err != gcache.KeyNotFoundError {
-		logger.Printf("unable to get %s off arc stack: %s", addr, err)
+	// Zones only apply to the local host, so have no bearing on the lookup.
+	if i := strings.IndexByte(addr, '%'); i != -1 && strings.Contains(addr[:i], ":") {
+		addr = addr[:i]
 	}
 
-	ip := net.ParseIP(addr)
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+
+	return addr
+}
+
+// resolveError is returned when a hostname could not be resolved.
+type resolveError struct {
+	host string
+	err  error
+}
+
+func (e *resolveError) Error() string {
+	// Don't expose which resolver was used.
+	var dnsErr *net.DNSError
+	if errors.As(e.err, &dnsErr) {
+		return fmt.Sprintf("unable to resolve host %s: %s", e.host, dnsErr.Err)
+	}
+
+	return fmt.Sprintf("unable to resolve host %s: %s", e.host, e.err)
+}
+
+// parseAddr parses addr as an IP address, resolving it if it's a hostname.
+// When resolved, all addresses of the host are also returned, the first of
+// which is used. Private/reserved addresses return errReservedAddr, unless
+// allowPrivate is true. Returned errors are safe to show to the user.
+func parseAddr(ctx context.Context, addr string, allowPrivate bool) (ip net.IP, addrs []net.IP, err error) {
+	addr = normalizeAddr(addr)
+
+	ip = net.ParseIP(addr)
 	if ip == nil {
-		var ips []string
-		ips, err = net.LookupHost(addr)
-		if err != nil || len(ips) == 0 {
+		if strings.ContainsAny(addr, ":[]%") {
+			return nil, nil, errInvalidAddr
+		}
+
+		if flags.HTTP.DisableHostname {
+			return nil, nil, errHostnameDisabled
+		}
+
+		dnsCtx, cancel := context.WithTimeout(ctx, flags.DNS.Timeout)
+		defer cancel()
+
+		var hosts []string
+		hosts, err = resolver.LookupHost(dnsCtx, addr)
+		if err == nil && len(hosts) == 0 {
+			err = errors.New("no addresses found")
+		}
+
+		if err != nil {
 			logger.Printf("error looking up %q as host address: %s", addr, err)
+			return nil, nil, &resolveError{host: addr, err: err}
+		}
 
-			result = &AddrResult{Error: fmt.Sprintf("invalid ip/host specified: %s", addr)}
-			apiResponse(w, r, result, filters)
-			return
+		for i := 0; i < len(hosts); i++ {
+			if hostIP := net.ParseIP(hosts[i]); hostIP != nil {
+				addrs = append(addrs, hostIP)
+			}
+		}
+
+		if len(addrs) == 0 {
+			return nil, nil, &resolveError{host: addr, err: errors.New("no addresses found")}
 		}
 
-		ip = net.ParseIP(ips[0])
+		ip = addrs[0]
+	}
+
+	if !allowPrivate && reservedAddr(ip) {
+		return nil, nil, errReservedAddr
 	}
 
-	if is, _ := bogon.Is(ip.String()); is {
-		result = &AddrResult{Error: "internal address"}
-		apiResponse(w, r, result, filters)
+	return ip, addrs, nil
+}
+
+func apiBatchLookup(w http.ResponseWriter, r *http.Request) {
+	addrs, ok := decodeAddrs(w, r)
+	if !ok {
 		return
 	}
 
-	result, err = addrLookup(r.Context(), ip, filters)
+	serveBatch(w, r, addrs)
+}
+
+// decodeAddrs decodes the request body, a json array of addresses. false is
+// returned if an error has been written to the client.
+func decodeAddrs(w http.ResponseWriter, r *http.Request) (addrs []string, ok bool) {
+	err := json.NewDecoder(r.Body).Decode(&addrs)
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		errorResponse(w, r, http.StatusRequestEntityTooLarge, errCodeTooLarge, "request body too large (max: %d bytes)", maxErr.Limit)
+		return nil, false
+	}
+
 	if err != nil {
-		logger.Printf("error looking up address %q (%q): %s", addr, ip, err)
-		w.WriteHeader(http.StatusServiceUnavailable)
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "request body must be a json array of addresses")
+		return nil, false
+	}
+
+	return addrs, true
+}
+
+// apiQueryLookup is like apiBatchLookup, however the addresses are supplied as
+// a comma separated list with "ips" (e.g. "/api/lookup?ips=1.1.1.1,8.8.8.8").
+func apiQueryLookup(w http.ResponseWriter, r *http.Request) {
+	var addrs []string
+	for _, addr := range strings.Split(r.FormValue("ips"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	if len(addrs) == 0 {
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "no addresses supplied (use ?ips=<addr>,<addr>,...)")
+		return
+	}
+
+	serveBatch(w, r, addrs)
+}
+
+// serveBatch looks up each of addrs, responding with the results in the same
+// order. Each address is counted against the rate limit.
+func serveBatch(w http.ResponseWriter, r *http.Request, addrs []string) {
+	fields, err := parseFields(r, []AddrResult{})
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "%s", err)
+		return
+	}
+
+	format := responseFormat(r)
+
+	maxAddrs := flags.HTTP.BatchMax
+	if format == formatNDJSON {
+		maxAddrs = flags.HTTP.BatchStreamMax
+	}
+
+	if len(addrs) > maxAddrs {
+		errorResponse(w, r, http.StatusRequestEntityTooLarge, errCodeTooLarge, "too many addresses supplied (max: %d)", maxAddrs)
+		return
+	}
+
+	// The rate limiter has already counted this request once, so count the
+	// remaining addresses against the limit as well.
+	if len(addrs) > 1 && !hitLimit(w, r, uint64(len(addrs)-1)) {
+		return
+	}
+
+	opts := newLookupOptions(w, r)
+	opts.filters = topLevelFields(fields)
+
+	if format == formatNDJSON {
+		streamBatch(w, r, addrs, fields, opts)
+		return
+	}
+
+	results := lookupBatch(r.Context(), addrs, opts)
+
+	if format == formatCSV {
+		csvResponse(w, r, results, nil, "geoip-batch.csv")
+		return
+	}
+
+	if len(fields) > 0 {
+		var filtered interface{}
+
+		filtered, err = geoip.SelectFields(results, fields)
+		if err != nil {
+			panic(err)
+		}
+
+		jsonResponse(w, r, styleFields(filtered))
+		return
+	}
+
+	jsonResponse(w, r, styleFields(results))
+}
+
+// lookupBatch looks up each of addrs, returning the results in the same
+// order. Duplicate addresses are only looked up once, though still returned
+// at each of their positions.
+func lookupBatch(ctx context.Context, addrs []string, opts lookupOptions) []*AddrResult {
+	results := make([]*AddrResult, len(addrs))
+	seen := make(map[string]*AddrResult, len(addrs))
+
+	var err error
+	for i := 0; i < len(addrs); i++ {
+		addr := strings.TrimSpace(addrs[i])
+		if result, ok := seen[addr]; ok {
+			results[i] = result
+			continue
+		}
+
+		results[i], _, err = lookupAddr(ctx, addr, opts)
+		if err != nil {
+			results[i] = &AddrResult{Error: "unable to query database"}
+		}
+		seen[addr] = results[i]
+	}
+
+	return results
+}
+
+// ndjsonResult is a single result of a streaming batch lookup. Results are
+// written as they complete, so index is the position of the address in the
+// request.
+type ndjsonResult struct {
+	Index int `json:"index"`
+	*AddrResult
+}
+
+// streamBatch looks up addrs concurrently, writing each result as a single
+// line of json (ndjson) as soon as it completes.
+func streamBatch(w http.ResponseWriter, r *http.Request, addrs, fields []string, opts lookupOptions) {
+	workers := flags.HTTP.BatchWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	results := make(chan ndjsonResult)
+
+	// Stop queuing lookups if the client goes away.
+	go func() {
+		defer close(jobs)
+
+		for i := 0; i < len(addrs); i++ {
+			select {
+			case jobs <- i:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				result, _, err := lookupAddr(r.Context(), strings.TrimSpace(addrs[i]), opts)
+				if err != nil {
+					result = &AddrResult{Error: "unable to query database"}
+				}
+
+				results <- ndjsonResult{Index: i, AddrResult: result}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	var failed bool
+	for result := range results {
+		// Keep draining results after a failed write, so the workers can
+		// exit.
+		if failed {
+			continue
+		}
+
+		var out interface{} = result
+		if len(fields) > 0 {
+			selected, err := geoip.SelectFields(result.AddrResult, fields)
+			if err != nil {
+				panic(err)
+			}
+
+			m, _ := selected.(map[string]interface{})
+			m["index"] = result.Index
+			out = m
+		}
+
+		if err := enc.Encode(styleFields(out)); err != nil {
+			logger.Printf("error during ndjson encode for %s: %s", r.RemoteAddr, err)
+			failed = true
+			continue
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func apiASNLookup(w http.ResponseWriter, r *http.Request) {
+	if flags.ASNPath == "" {
+		errorResponse(w, r, http.StatusNotImplemented, errCodeNotImplemented, "asn database not configured")
+		return
+	}
+
+	ip, _, err := parseAddr(r.Context(), strings.TrimSpace(chi.URLParam(r, "addr")), allowPrivate(r))
+	if err != nil {
+		addrErrorResponse(w, r, err)
+		return
+	}
+
+	result, err := asnLookup(ip)
+	if err != nil {
+		logger.Printf("error looking up asn for %q: %s", ip, err)
+		errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "unable to query database")
+		return
+	}
+
+	if result.Error != "" {
+		errorResponse(w, r, http.StatusNotFound, errCodeNotFound, "no results found for %s", ip)
+		return
+	}
+
+	jsonResponse(w, r, result)
+}
+
+func apiAnonymousLookup(w http.ResponseWriter, r *http.Request) {
+	if flags.AnonymousPath == "" {
+		errorResponse(w, r, http.StatusNotImplemented, errCodeNotImplemented, "anonymous ip database not configured")
 		return
 	}
 
-	if err = arc.Set(key, *result); err != nil {
-		logger.Printf("unable to add %s to arc cache: %s", addr, err)
+	ip, _, err := parseAddr(r.Context(), strings.TrimSpace(chi.URLParam(r, "addr")), allowPrivate(r))
+	if err != nil {
+		addrErrorResponse(w, r, err)
+		return
 	}
 
-	apiResponse(w, r, result, filters)
+	result, err := anonLookup(ip)
+	if err != nil {
+		logger.Printf("error looking up anonymity for %q: %s", ip, err)
+		errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "unable to query database")
+		return
+	}
+
+	jsonResponse(w, r, result)
 }
 
-func apiResponse(w http.ResponseWriter, r *http.Request, result *AddrResult, filters []string) {
+func apiISPLookup(w http.ResponseWriter, r *http.Request) {
+	if flags.ISPPath == "" {
+		errorResponse(w, r, http.StatusNotImplemented, errCodeNotImplemented, "isp database not configured")
+		return
+	}
+
+	ip, _, err := parseAddr(r.Context(), strings.TrimSpace(chi.URLParam(r, "addr")), allowPrivate(r))
+	if err != nil {
+		addrErrorResponse(w, r, err)
+		return
+	}
+
+	result, err := ispLookup(ip)
+	if err != nil {
+		logger.Printf("error looking up isp for %q: %s", ip, err)
+		errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "unable to query database")
+		return
+	}
+
+	if result.Error != "" {
+		errorResponse(w, r, http.StatusNotFound, errCodeNotFound, "no results found for %s", ip)
+		return
+	}
+
+	if flags.ConnectionTypePath != "" {
+		result.ConnectionType, err = connTypeLookup(ip)
+		if err != nil {
+			logger.Printf("error looking up connection type for %q: %s", ip, err)
+		}
+	}
+
+	jsonResponse(w, r, result)
+}
+
+func apiResponse(w http.ResponseWriter, r *http.Request, result *AddrResult, filters, fields []string) {
 	var err error
 
-	if len(filters) > 0 {
+	format := responseFormat(r)
+
+	if format == formatCSV {
+		csvResponse(w, r, []*AddrResult{result}, filters, "geoip.csv")
+		return
+	}
+
+	if len(filters) > 0 && format != formatText && format != formatXML {
 		if result.Error != "" {
-			fmt.Fprintf(w, "err: %s", result.Error)
+			if result.status != 0 {
+				errorResponse(w, r, result.status, result.code, "%s", result.Error)
+				return
+			}
+
+			errorResponse(w, r, http.StatusNotFound, errCodeNotFound, "no results found for %s", result.IP)
 			return
 		}
 
@@ -135,7 +995,11 @@ func apiResponse(w http.ResponseWriter, r *http.Request, result *AddrResult, fil
 
 		out := make([]string, len(filters))
 		for i := 0; i < len(filters); i++ {
-			out[i] = strings.ReplaceAll(fmt.Sprintf("%s", *base[filters[i]]), "\"", "")
+			// Fields which are omitted when empty (e.g. postal_code) have no
+			// value.
+			if value := base[filters[i]]; value != nil {
+				out[i] = strings.ReplaceAll(fmt.Sprintf("%s", *value), "\"", "")
+			}
 		}
 
 		w.Header().Set("Content-Type", "text/plain")
@@ -143,33 +1007,194 @@ func apiResponse(w http.ResponseWriter, r *http.Request, result *AddrResult, fil
 		return
 	}
 
-	enc := json.NewEncoder(w)
+	var out interface{} = result
 
-	if ok, _ := strconv.ParseBool(r.FormValue("pretty")); ok {
+	switch format {
+	case formatText:
+		textResponse(w, result, out, strings.TrimSpace(r.FormValue("field")))
+		return
+	case formatXML:
+		xmlResponse(w, r, http.StatusOK, out)
+		return
+	}
+
+	if len(fields) > 0 {
+		out, err = geoip.SelectFields(out, fields)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	jsonResponse(w, r, styleFields(out))
+}
+
+// reCallback matches valid JSONP callback names.
+var reCallback = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$.]*$`)
+
+// jsonResponse encodes v as json to the client, with indentation if the
+// client has requested it.
+func jsonResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
+	jsonStatusResponse(w, r, http.StatusOK, v)
+}
+
+// jsonStatusResponse is like jsonResponse, however with a custom status code.
+func jsonStatusResponse(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	// Wrap the response in the supplied callback (JSONP), for clients which
+	// can't use CORS.
+	callback := r.FormValue("callback")
+	if callback != "" && !reCallback.MatchString(callback) {
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "invalid callback specified")
+		return
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	// Indentation isn't part of the lookup cache key, so cached results are
+	// shared between compact and pretty responses.
+	if prettyPrint(r) {
 		enc.SetIndent("", "  ")
 	}
 
 	enc.SetEscapeHTML(false) // Otherwise the map url will get unicoded.
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	err = enc.Encode(result)
-	if err != nil {
+	if err := enc.Encode(v); err != nil {
 		logger.Printf("error during json encode for %s: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if callback == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = buf.WriteTo(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "/**/%s(%s);\n", callback, bytes.TrimSpace(buf.Bytes()))
+}
+
+// MetaResult contains the metadata of the currently loaded database.
+type MetaResult struct {
+	DatabaseType string            `json:"database_type"`
+	Description  map[string]string `json:"description"`
+	BuildDate    time.Time         `json:"build_date"`
+	BuildEpoch   uint              `json:"build_epoch"`
+	Version      string            `json:"binary_format_version"`
+	IPVersion    uint              `json:"ip_version"`
+	Languages    []string          `json:"languages"`
+	NodeCount    uint              `json:"node_count"`
+	RecordSize   uint              `json:"record_size"`
+}
+
+// apiMeta returns the metadata of the currently loaded database.
+func apiMeta(w http.ResponseWriter, r *http.Request) {
+	mcache.RLock()
+	meta := mcache.cache
+	mcache.RUnlock()
+
+	if meta == nil {
+		errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "%s", errDBNotLoaded)
+		return
 	}
+
+	jsonResponse(w, r, newMetaResult(meta))
 }
 
+// newMetaResult returns the api representation of the database metadata.
+func newMetaResult(meta *maxminddb.Metadata) *MetaResult {
+	return &MetaResult{
+		DatabaseType: meta.DatabaseType,
+		Description:  meta.Description,
+		BuildDate:    time.Unix(int64(meta.BuildEpoch), 0).UTC(),
+		BuildEpoch:   meta.BuildEpoch,
+		Version:      fmt.Sprintf("%d.%d", meta.BinaryFormatMajorVersion, meta.BinaryFormatMinorVersion),
+		IPVersion:    meta.IPVersion,
+		Languages:    meta.Languages,
+		NodeCount:    meta.NodeCount,
+		RecordSize:   meta.RecordSize,
+	}
+}
+
+// requestDatabases returns the metadata of each loaded database which answers
+// the request, i.e. the database of the endpoint, and for regular lookups,
+// any of the requested optional databases which are loaded. The database of
+// the endpoint is always first, and nil is returned if it isn't loaded.
+func requestDatabases(r *http.Request) (metas []*maxminddb.Metadata) {
+	cache := mcache
+	enrich := true
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/asn/"):
+		cache, enrich = asnMcache, false
+	case strings.HasPrefix(r.URL.Path, "/api/anonymous/"):
+		cache, enrich = anonMcache, false
+	case strings.HasPrefix(r.URL.Path, "/api/isp/"):
+		cache, enrich = ispMcache, false
+	}
+
+	cache.RLock()
+	if cache.cache == nil {
+		cache.RUnlock()
+		return nil
+	}
+	metas = append(metas, cache.cache)
+	cache.RUnlock()
+
+	if include := parseInclude(r); enrich && len(include) > 0 {
+		requested := make(map[string]bool, len(include))
+		for i := 0; i < len(include); i++ {
+			requested[include[i]] = true
+		}
+
+		for _, e := range enrichments {
+			if !requested[e.name] {
+				continue
+			}
+
+			e.meta.RLock()
+			if e.meta.cache != nil {
+				metas = append(metas, e.meta.cache)
+			}
+			e.meta.RUnlock()
+		}
+	}
+
+	return metas
+}
+
+// dbDetailsMiddleware adds the type and build of the database(s) answering
+// the request as headers, along with when the response was generated, and the
+// age (in days) of the oldest of the databases.
 func dbDetailsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		mcache.RLock()
-		if mcache.cache == nil {
-			mcache.RUnlock()
+		// Reflect the database(s) which will be answering the request.
+		metas := requestDatabases(r)
+		if metas == nil {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		w.Header().Set("X-Maxmind-Build", fmt.Sprintf("%d-%d", mcache.cache.IPVersion, mcache.cache.BuildEpoch))
-		w.Header().Set("X-Maxmind-Type", mcache.cache.DatabaseType)
-		mcache.RUnlock()
+		// The age is of the oldest database, so downstream systems can flag
+		// results which may be stale.
+		types := make([]string, len(metas))
+		oldest := metas[0].BuildEpoch
+		for i := 0; i < len(metas); i++ {
+			types[i] = metas[i].DatabaseType
+
+			if metas[i].BuildEpoch < oldest {
+				oldest = metas[i].BuildEpoch
+			}
+		}
+
+		now := time.Now().UTC()
+		age := now.Sub(time.Unix(int64(oldest), 0)) / (24 * time.Hour)
+
+		w.Header().Set("X-Maxmind-Build", fmt.Sprintf("%d-%d", metas[0].IPVersion, metas[0].BuildEpoch))
+		w.Header().Set("X-Maxmind-Type", strings.Join(types, ","))
+		w.Header().Set("X-Generated-At", now.Format(time.RFC3339))
+		w.Header().Set("X-Database-Age", strconv.Itoa(int(age)))
 
 		next.ServeHTTP(w, r)
 	})
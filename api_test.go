@@ -0,0 +1,203 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bluele/gcache"
+	"github.com/go-chi/chi"
+)
+
+func TestNormalizeAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		// Compressed.
+		{"2001:db8::1", "2001:db8::1"},
+		{" 2001:db8::1 ", "2001:db8::1"},
+		{"2001:DB8::1", "2001:db8::1"},
+		// Expanded.
+		{"2001:0db8:0000:0000:0000:0000:0000:0001", "2001:db8::1"},
+		{"2001:db8:0:0:0:0:0:1", "2001:db8::1"},
+		// Bracketed, and with a zone.
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]", "fe80::1"},
+		// IPv4-mapped.
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"::FFFF:102:304", "1.2.3.4"},
+		// Loopback.
+		{"::1", "::1"},
+		{"0:0:0:0:0:0:0:1", "::1"},
+		{"127.0.0.1", "127.0.0.1"},
+		// IPv4.
+		{"8.8.8.8", "8.8.8.8"},
+		// Hostnames (and invalid addresses) are returned as-is.
+		{"example.com", "example.com"},
+		{"2001:db8::zz", "2001:db8::zz"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeAddr(tt.in); got != tt.want {
+			t.Errorf("normalizeAddr(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseAddrInvalid(t *testing.T) {
+	for _, addr := range []string{"2001:db8::zz", "1.2.3.4:80", "[2001:db8::1", "gggg::1", "::ffff:1.2.3"} {
+		if _, _, err := parseAddr(context.Background(), addr, false); !errors.Is(err, errInvalidAddr) {
+			t.Errorf("parseAddr(%q) error = %v, want %v", addr, err, errInvalidAddr)
+		}
+	}
+
+	// Loopback addresses are reserved, unless allowed.
+	for _, addr := range []string{"::1", "127.0.0.1", "::ffff:127.0.0.1"} {
+		if _, _, err := parseAddr(context.Background(), addr, false); !errors.Is(err, errReservedAddr) {
+			t.Errorf("parseAddr(%q) error = %v, want %v", addr, err, errReservedAddr)
+		}
+
+		if _, _, err := parseAddr(context.Background(), addr, true); err != nil {
+			t.Errorf("parseAddr(%q, allowPrivate) error = %v, want nil", addr, err)
+		}
+	}
+}
+
+func TestLookupInvalidAddr(t *testing.T) {
+	lookupCache = newMemoryCache(10)
+	defer func() { lookupCache = nil }()
+
+	r := chi.NewRouter()
+	r.Get("/api/{addr}", apiLookup)
+
+	for _, addr := range []string{"2001:db8::zz", "[2001:db8::1"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/"+addr, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("lookup of %q: status = %d, want %d", addr, w.Code, http.StatusBadRequest)
+			continue
+		}
+
+		var resp struct {
+			Error struct {
+				Code   int    `json:"code"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("lookup of %q: invalid response %q: %s", addr, w.Body.String(), err)
+			continue
+		}
+
+		if resp.Error.Code != int(errCodeInvalidIP) || resp.Error.Reason != errCodeInvalidIP.reason() {
+			t.Errorf("lookup of %q: error = %+v, want code %d", addr, resp.Error, errCodeInvalidIP)
+		}
+	}
+}
+
+func TestDatabaseLookupInvalidAddr(t *testing.T) {
+	// The databases aren't used, as the addresses are rejected first.
+	flags.ASNPath, flags.AnonymousPath, flags.ISPPath = "asn.mmdb", "anonymous.mmdb", "isp.mmdb"
+	defer func() { flags.ASNPath, flags.AnonymousPath, flags.ISPPath = "", "", "" }()
+
+	r := chi.NewRouter()
+	r.Get("/api/asn/{addr}", apiASNLookup)
+	r.Get("/api/anonymous/{addr}", apiAnonymousLookup)
+	r.Get("/api/isp/{addr}", apiISPLookup)
+
+	tests := []struct {
+		addr   string
+		status int
+		code   errorCode
+	}{
+		{"2001:db8::zz", http.StatusBadRequest, errCodeInvalidIP},
+		{"[2001:db8::1", http.StatusBadRequest, errCodeInvalidIP},
+		{"127.0.0.1", http.StatusUnprocessableEntity, errCodeReservedRange},
+		{"::1", http.StatusUnprocessableEntity, errCodeReservedRange},
+	}
+
+	for _, endpoint := range []string{"asn", "anonymous", "isp"} {
+		for _, tt := range tests {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/"+endpoint+"/"+tt.addr, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("%s lookup of %q: status = %d, want %d", endpoint, tt.addr, w.Code, tt.status)
+				continue
+			}
+
+			var resp struct {
+				Error struct {
+					Code   int    `json:"code"`
+					Reason string `json:"reason"`
+				} `json:"error"`
+			}
+
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Errorf("%s lookup of %q: invalid response %q: %s", endpoint, tt.addr, w.Body.String(), err)
+				continue
+			}
+
+			if resp.Error.Code != int(tt.code) || resp.Error.Reason != tt.code.reason() {
+				t.Errorf("%s lookup of %q: error = %+v, want code %d", endpoint, tt.addr, resp.Error, tt.code)
+			}
+		}
+	}
+}
+
+func TestLookupRDNS(t *testing.T) {
+	db = &DB{path: "geoip/testdata/GeoLite2-City-Test.mmdb", meta: &metaCache{}}
+	if err := db.load(); err != nil {
+		t.Fatalf("unable to load database: %s", err)
+	}
+	defer func() { db = nil }()
+
+	// Cached, so no dns lookups are made.
+	ptrCache = gcache.New(10).LRU().Build()
+	defer func() { ptrCache = nil }()
+	_ = ptrCache.Set("1.0.0.1", "one.example.com")
+	_ = ptrCache.Set("1.0.0.2", "")
+
+	tests := []struct {
+		addr     string
+		rdns     bool
+		host     string
+		hostname string
+	}{
+		{addr: "1.0.0.1", host: "one.example.com"},
+		{addr: "1.0.0.1", rdns: true, host: "one.example.com", hostname: "one.example.com"},
+		// No PTR record.
+		{addr: "1.0.0.2", rdns: true},
+	}
+
+	for _, tt := range tests {
+		result, err := addrLookup(context.Background(), net.ParseIP(tt.addr), lookupOptions{rdns: tt.rdns})
+		if err != nil {
+			t.Fatalf("lookup of %s: %s", tt.addr, err)
+		}
+
+		if result.Host != tt.host {
+			t.Errorf("lookup of %s (rdns: %t): host = %q, want %q", tt.addr, tt.rdns, result.Host, tt.host)
+		}
+
+		if tt.hostname == "" {
+			if result.Hostname != nil {
+				t.Errorf("lookup of %s (rdns: %t): hostname = %q, want nil", tt.addr, tt.rdns, *result.Hostname)
+			}
+		} else if result.Hostname == nil || *result.Hostname != tt.hostname {
+			t.Errorf("lookup of %s (rdns: %t): hostname = %v, want %q", tt.addr, tt.rdns, result.Hostname, tt.hostname)
+		}
+	}
+}
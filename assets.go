@@ -0,0 +1,171 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressibleTypes are the content types of assets which are pre-compressed.
+// Other types (e.g. images and fonts) are generally already compressed.
+var compressibleTypes = []string{
+	"text/", "application/javascript", "application/json", "image/svg+xml",
+}
+
+// asset is a single embedded static asset. As the assets are embedded into
+// the binary, they are immutable, and only need to be hashed and compressed
+// once.
+type asset struct {
+	contentType string
+	etag        string
+
+	// Encoded variants of the asset, keyed by content encoding ("" is the
+	// original). Variants are only kept if smaller than the original.
+	variants map[string][]byte
+}
+
+// loadAssets reads, hashes (for a strong ETag) and pre-compresses (gzip and
+// brotli) each file within fsys, keyed by its path.
+func loadAssets(fsys fs.FS) (map[string]*asset, error) {
+	assets := make(map[string]*asset)
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(b)
+		a := &asset{
+			contentType: mime.TypeByExtension(path.Ext(name)),
+			etag:        hex.EncodeToString(sum[:16]),
+			variants:    map[string][]byte{"": b},
+		}
+
+		if a.contentType == "" {
+			a.contentType = http.DetectContentType(b)
+		}
+
+		if compressible(a.contentType) {
+			for encoding, newWriter := range map[string]func(io.Writer) io.WriteCloser{
+				"br": func(w io.Writer) io.WriteCloser { return brotli.NewWriterLevel(w, brotli.BestCompression) },
+				"gzip": func(w io.Writer) io.WriteCloser {
+					zw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+					return zw
+				},
+			} {
+				var buf bytes.Buffer
+				zw := newWriter(&buf)
+				if _, err = zw.Write(b); err != nil {
+					return err
+				}
+				if err = zw.Close(); err != nil {
+					return err
+				}
+
+				if buf.Len() < len(b) {
+					a.variants[encoding] = buf.Bytes()
+				}
+			}
+		}
+
+		assets[name] = a
+		return nil
+	})
+
+	return assets, err
+}
+
+// compressible returns true if assets of contentType should be compressed.
+func compressible(contentType string) bool {
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptsEncoding returns true if the Accept-Encoding header of the request
+// allows the provided content encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(accept), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// assetHandler serves the static assets within fsys, using the pre-compressed
+// variant the client accepts (if any), so they aren't compressed on every
+// request. The ETag of each variant is set, so conditional requests
+// (If-None-Match) can be answered with a 304 Not Modified.
+func assetHandler(fsys fs.FS, assets map[string]*asset) http.Handler {
+	fileServer := http.FileServer(http.FS(fsys))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("Cache-Control", "public, max-age=7776000")
+
+		a, ok := assets[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			// e.g. directories, or missing assets.
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+
+		var encoding string
+		for _, e := range []string{"br", "gzip"} {
+			if _, ok = a.variants[e]; ok && acceptsEncoding(r, e) {
+				encoding = e
+				break
+			}
+		}
+
+		// Each variant is a different representation, so has a different
+		// ETag. Responses with a Content-Encoding are also skipped by the
+		// compression middleware.
+		w.Header().Set("Content-Type", a.contentType)
+		if encoding == "" {
+			w.Header().Set("ETag", `"`+a.etag+`"`)
+		} else {
+			w.Header().Set("ETag", `"`+a.etag+"-"+encoding+`"`)
+			w.Header().Set("Content-Encoding", encoding)
+		}
+
+		// http.ServeContent handles If-None-Match itself, as long as the ETag
+		// is already set.
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(a.variants[encoding]))
+	})
+}
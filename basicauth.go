@@ -0,0 +1,144 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicCredential is the password of a user allowed by --http.basic-auth.
+type basicCredential struct {
+	password string
+	// hashed is true if password is from a htpasswd file, which may be a
+	// bcrypt or {SHA} hash (or plain text).
+	hashed bool
+}
+
+// basicCredentials are the users allowed by --http.basic-auth. nil if basic
+// auth is disabled.
+var basicCredentials map[string]basicCredential
+
+// basicVerified caches the credentials (as a hash of user:pass) which have
+// been verified, as bcrypt is intentionally slow.
+var basicVerified sync.Map
+
+// loadBasicAuth loads the credentials of --http.basic-auth, which is either
+// the path to a htpasswd file, or a single user:pass.
+func loadBasicAuth(value string) error {
+	basicCredentials = nil
+	if value == "" {
+		return nil
+	}
+
+	basicCredentials = make(map[string]basicCredential)
+
+	f, err := os.Open(value)
+	if errors.Is(err, os.ErrNotExist) {
+		user, pass, ok := strings.Cut(value, ":")
+		if !ok || user == "" {
+			return errors.New("must be a path to a htpasswd file, or in user:pass form")
+		}
+
+		basicCredentials[user] = basicCredential{password: pass}
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("%s: line %d: expected user:hash", value, i)
+		}
+
+		if strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "$1$") {
+			return fmt.Errorf("%s: line %d: md5 hashes aren't supported (use bcrypt, i.e. htpasswd -B)", value, i)
+		}
+
+		basicCredentials[user] = basicCredential{password: hash, hashed: true}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(basicCredentials) == 0 {
+		return fmt.Errorf("%s: no users found", value)
+	}
+
+	return nil
+}
+
+// verify returns true if pass matches the credential.
+func (c basicCredential) verify(pass string) bool {
+	switch {
+	case c.hashed && strings.HasPrefix(c.password, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(c.password), []byte(pass)) == nil
+	case c.hashed && strings.HasPrefix(c.password, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(c.password[5:])) == 1
+	}
+
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(c.password)) == 1
+}
+
+// basicAuth requires one of the users of --http.basic-auth to be supplied
+// with http basic authentication, if enabled. Preflight (OPTIONS) requests
+// are always allowed, as browsers don't send credentials with them.
+func basicAuth(next http.Handler) http.Handler {
+	if basicCredentials == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, pass, ok := r.BasicAuth()
+		if ok {
+			key := sha256.Sum256([]byte(user + ":" + pass))
+
+			if _, verified := basicVerified.Load(key); !verified {
+				cred, known := basicCredentials[user]
+				ok = known && cred.verify(pass)
+
+				if ok {
+					basicVerified.Store(key, struct{}{})
+				}
+			}
+		}
+
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="geoip", charset="UTF-8"`)
+			errorResponse(w, r, http.StatusUnauthorized, errCodeUnauthorized, "invalid or missing credentials")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
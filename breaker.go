@@ -0,0 +1,166 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states. The values are also those of the
+// geoip_breaker_state metric.
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+var breakerStates = map[int]string{
+	breakerClosed:   "closed",
+	breakerHalfOpen: "half-open",
+	breakerOpen:     "open",
+}
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// breaker is a circuit breaker around calls to an external dependency (e.g.
+// rdns, or database downloads). After threshold consecutive failures, the
+// breaker opens, and calls aren't attempted for cooldown. After the cooldown,
+// a single call is allowed through (half-open), which either closes the
+// breaker again, or re-opens it.
+type breaker struct {
+	name      string
+	threshold int // 0 disables the breaker.
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	opened   time.Time
+	probing  bool // If a half-open call is in flight.
+}
+
+// newBreaker returns a closed breaker, using the --breaker.* options.
+func newBreaker(name string) *breaker {
+	b := &breaker{
+		name:      name,
+		threshold: flags.Breaker.Threshold,
+		cooldown:  flags.Breaker.Cooldown,
+	}
+
+	metricBreakerState.WithLabelValues(name).Set(breakerClosed)
+	return b
+}
+
+// allow returns true if a call should be attempted. If true, the result of
+// the call must be reported with done (or cancel), passing probe, which is
+// true if the call is the single half-open call.
+func (b *breaker) allow() (probe, ok bool) {
+	if b.threshold <= 0 {
+		return false, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.opened) < b.cooldown {
+			return false, false
+		}
+
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true, true
+	case breakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+
+		b.probing = true
+		return true, true
+	}
+
+	return false, true
+}
+
+// done reports the result of a call allowed by allow. Only the result of the
+// half-open call moves the breaker out of open, so late results of calls
+// allowed before the breaker opened are ignored.
+func (b *breaker) done(probe, failed bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+
+		if failed {
+			b.failures++
+			b.opened = time.Now()
+			b.setState(breakerOpen)
+			return
+		}
+
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	if b.state != breakerClosed {
+		return
+	}
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	if b.failures++; b.failures >= b.threshold {
+		b.opened = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// cancel reports that a call allowed by allow was abandoned (e.g. the request
+// was cancelled), so it neither succeeded nor failed.
+func (b *breaker) cancel(probe bool) {
+	if b.threshold <= 0 || !probe {
+		return
+	}
+
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// call invokes fn if the breaker allows it, reporting its result. If not,
+// errBreakerOpen is returned.
+func (b *breaker) call(fn func() error) error {
+	probe, ok := b.allow()
+	if !ok {
+		return errBreakerOpen
+	}
+
+	err := fn()
+	b.done(probe, err != nil)
+	return err
+}
+
+// setState transitions the breaker to state. b.mu must be held.
+func (b *breaker) setState(state int) {
+	if state == breakerOpen {
+		logger.Printf("%s circuit breaker open after %d consecutive failures, retrying in %s", b.name, b.failures, b.cooldown)
+	} else {
+		logger.Printf("%s circuit breaker %s", b.name, breakerStates[state])
+	}
+
+	b.state = state
+	metricBreakerState.WithLabelValues(b.name).Set(float64(state))
+}
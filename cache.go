@@ -0,0 +1,176 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// noCacheHeaders are the headers set on responses which must not be cached,
+// matching middleware.NoCache.
+var noCacheHeaders = map[string]string{
+	"Expires":         time.Unix(0, 0).UTC().Format(http.TimeFormat),
+	"Cache-Control":   "no-cache, no-store, no-transform, must-revalidate, private, max-age=0",
+	"Pragma":          "no-cache",
+	"X-Accel-Expires": "0",
+}
+
+// cacheControl returns a middleware which allows successful lookups to be
+// cached (e.g. by a CDN) for maxAge. Error responses, and responses which
+// handlers mark as depending on the client with privateResponse (e.g.
+// /api/self), are never cached. If maxAge is 0, no responses are cached.
+//
+// Cached responses are also marked with a Last-Modified of the latest build
+// of the database(s) answering the request, as results only change when the
+// database does, and If-Modified-Since requests are answered with a 304 if
+// the database hasn't been rebuilt since.
+func cacheControl(maxAge time.Duration) func(next http.Handler) http.Handler {
+	if maxAge <= 0 {
+		return middleware.NoCache
+	}
+
+	return func(next http.Handler) http.Handler {
+		noCache := middleware.NoCache(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				noCache.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &cacheHeaderWriter{ResponseWriter: w, maxAge: maxAge, modified: lastModified(r), private: new(bool)}
+			r = r.WithContext(context.WithValue(r.Context(), privateKey{}, cw.private))
+
+			// Whether the response depends on the client is only known once
+			// the handler responds, so conditional requests are answered by
+			// the writer.
+			if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+				cw.since = since
+			}
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+type privateKey struct{}
+
+// privateResponse marks the response to r as depending on the client (e.g.
+// lookups of the client's own address), so it's never cached. It must be
+// called before the response is written.
+func privateResponse(r *http.Request) {
+	if private, ok := r.Context().Value(privateKey{}).(*bool); ok {
+		*private = true
+	}
+}
+
+// lastModified returns the latest build time of the database(s) answering
+// the request, or the zero time if the database isn't loaded.
+func lastModified(r *http.Request) (modified time.Time) {
+	for _, meta := range requestDatabases(r) {
+		if built := time.Unix(int64(meta.BuildEpoch), 0).UTC(); built.After(modified) {
+			modified = built
+		}
+	}
+
+	return modified
+}
+
+// cacheHeaderWriter sets the caching headers of the response once the status
+// code is known.
+type cacheHeaderWriter struct {
+	http.ResponseWriter
+	maxAge      time.Duration
+	modified    time.Time
+	since       time.Time // If-Modified-Since of the request, if any.
+	private     *bool
+	wroteHeader bool
+	// notModified is true if the request was answered with a 304, so the
+	// body is discarded.
+	notModified bool
+}
+
+func (w *cacheHeaderWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+
+		if !*w.private && (status == http.StatusOK || status == http.StatusNotModified) {
+			if status == http.StatusOK && !w.modified.IsZero() && !w.since.IsZero() && !w.modified.After(w.since) {
+				status = http.StatusNotModified
+				w.notModified = true
+
+				for _, k := range []string{"Content-Type", "Content-Length"} {
+					w.Header().Del(k)
+				}
+			}
+
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(w.maxAge.Seconds())))
+			addVary(w.Header(), "Accept", "Accept-Language", "Accept-Encoding")
+
+			if !w.modified.IsZero() {
+				w.Header().Set("Last-Modified", w.modified.Format(http.TimeFormat))
+			}
+		} else {
+			for k, v := range noCacheHeaders {
+				w.Header().Set(k, v)
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack implements http.Hijacker, for websocket connections.
+func (w *cacheHeaderWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// addVary adds each of the headers to the Vary header, unless already
+// present.
+func addVary(h http.Header, headers ...string) {
+	existing := make(map[string]bool)
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			existing[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	for _, name := range headers {
+		if !existing[http.CanonicalHeaderKey(name)] {
+			h.Add("Vary", name)
+		}
+	}
+}
+
+func (w *cacheHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.notModified {
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush is needed for streamed responses (e.g. ndjson batch lookups).
+func (w *cacheHeaderWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+
+		f.Flush()
+	}
+}
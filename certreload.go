@@ -0,0 +1,134 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves a static tls certificate (--http.tls.cert/key), which
+// is transparently reloaded when the files change on disk, or on SIGHUP, so
+// certificates can be rotated without a restart.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	certMtime time.Time
+	keyMtime  time.Time
+}
+
+// newCertReloader loads the certificate and key at the provided paths,
+// returning an error if they aren't a valid pair.
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// load reads and validates the certificate and key, and atomically swaps them
+// in. If they fail to load, are mismatched, or the certificate has expired,
+// the previous certificate (if any) continues to be used.
+func (c *certReloader) load() error {
+	certMtime, keyMtime, err := c.mtimes()
+	if err != nil {
+		return err
+	}
+
+	// The key must match the certificate.
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	if cert.Leaf != nil && time.Now().After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.certMtime, c.keyMtime = certMtime, keyMtime
+	c.mu.Unlock()
+
+	return nil
+}
+
+// mtimes returns the modification times of the certificate and key.
+func (c *certReloader) mtimes() (certMtime, keyMtime time.Time, err error) {
+	stat, err := os.Stat(c.certPath)
+	if err != nil {
+		return certMtime, keyMtime, err
+	}
+	certMtime = stat.ModTime()
+
+	if stat, err = os.Stat(c.keyPath); err != nil {
+		return certMtime, keyMtime, err
+	}
+
+	return certMtime, stat.ModTime(), nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// watch reloads the certificate on SIGHUP, and when either of the files
+// change on disk (checked every interval, if positive).
+func (c *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var attemptedCert, attemptedKey time.Time
+
+	for {
+		select {
+		case <-hup:
+			logger.Printf("received SIGHUP, reloading tls certificate %q", c.certPath)
+		case <-tick:
+			certMtime, keyMtime, err := c.mtimes()
+			if err != nil {
+				continue
+			}
+
+			c.mu.RLock()
+			changed := !certMtime.Equal(c.certMtime) || !keyMtime.Equal(c.keyMtime)
+			c.mu.RUnlock()
+
+			// Only attempt to load each modification once, so a bad pair
+			// (e.g. while only one of the files has been replaced) isn't
+			// continuously reloaded.
+			if !changed || (certMtime.Equal(attemptedCert) && keyMtime.Equal(attemptedKey)) {
+				continue
+			}
+			attemptedCert, attemptedKey = certMtime, keyMtime
+
+			logger.Printf("tls certificate %q changed on disk, reloading", c.certPath)
+		}
+
+		if err := c.load(); err != nil {
+			logger.Printf("error reloading tls certificate %q (continuing to use previous): %s", c.certPath, err)
+		}
+	}
+}
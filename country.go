@@ -0,0 +1,47 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/lrstanley/geoip/geoip"
+)
+
+// SubdivisionsResult is the list of subdivisions of a country.
+type SubdivisionsResult struct {
+	XMLName      xml.Name              `json:"-" xml:"geoip"`
+	CountryCode  string                `json:"country_abbr" xml:"country_abbr"`
+	Subdivisions geoip.SubdivisionList `json:"subdivisions" xml:"subdivisions"`
+}
+
+// apiCountrySubdivisions returns the ISO 3166-2 subdivisions (e.g. states)
+// of a country, from the embedded table (the database isn't used). Names are
+// only available in English.
+func apiCountrySubdivisions(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToUpper(strings.TrimSpace(chi.URLParam(r, "iso")))
+	if len(code) != 2 {
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "invalid country code specified: %s (must be iso 3166-1 alpha-2)", code)
+		return
+	}
+
+	result := &SubdivisionsResult{CountryCode: code, Subdivisions: geoip.CountrySubdivisions(code)}
+	if result.Subdivisions == nil {
+		errorResponse(w, r, http.StatusNotFound, errCodeNotFound, "no subdivisions found for country %s", code)
+		return
+	}
+
+	w.Header().Set("Content-Language", "en")
+
+	if responseFormat(r) == formatXML {
+		xmlResponse(w, r, http.StatusOK, result)
+		return
+	}
+
+	jsonResponse(w, r, result)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	_ "embed"
+	"os"
+	"strings"
+)
+
+// defaultDatacenters is the default list of ASN organization patterns of
+// datacenter/hosting providers, used unless --datacenter-list is provided.
+//
+//go:embed data/datacenters.txt
+var defaultDatacenters string
+
+// datacenterPatterns are the lowercased ASN organization patterns of
+// datacenter/hosting providers. Patterns prefixed with "=" must match exactly,
+// otherwise they match as a substring.
+var datacenterPatterns []string
+
+// loadDatacenters loads the datacenter patterns from the file at path, or the
+// embedded default list if path is empty.
+func loadDatacenters(path string) error {
+	raw := defaultDatacenters
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		raw = string(b)
+	}
+
+	datacenterPatterns = nil
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		datacenterPatterns = append(datacenterPatterns, line)
+	}
+
+	return nil
+}
+
+// isDatacenter is a heuristic to determine if the address of result belongs
+// to a datacenter/hosting provider, based on the ASN organization (if known)
+// and the anonymous ip database (if merged in). nil is returned if neither
+// are available.
+func isDatacenter(result *AddrResult) *bool {
+	if result.ASNOrg == "" && result.IsHostingProvider == nil {
+		return nil
+	}
+
+	var matched bool
+	if result.IsHostingProvider != nil && *result.IsHostingProvider {
+		matched = true
+	}
+
+	org := strings.ToLower(result.ASNOrg)
+	for i := 0; i < len(datacenterPatterns) && !matched && org != ""; i++ {
+		if exact := strings.TrimPrefix(datacenterPatterns[i], "="); exact != datacenterPatterns[i] {
+			matched = org == exact
+		} else {
+			matched = strings.Contains(org, datacenterPatterns[i])
+		}
+	}
+
+	return &matched
+}
@@ -8,22 +8,41 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
-	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/lrstanley/geoip/geoip"
 	maxminddb "github.com/oschwald/maxminddb-golang"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// DB is a geoip database on disk, which is kept open for lookups, and is
+// transparently reloaded when the file changes.
 type DB struct {
-	path string
+	path   string
+	vendor string // Format of the database, defaults to geoip.VendorMaxMind.
+	meta   *metaCache
+
+	// check, if set, is invoked with each newly opened database before it is
+	// swapped in. If it returns an error, the database isn't used.
+	check func(reader *geoip.Reader) error
+
+	mu     sync.RWMutex
+	reader *geoip.Reader
+	mtime  time.Time
+	etag   string // Only used for remote databases.
 }
 
 // Note that cache may not always be filled.
@@ -32,7 +51,253 @@ type metaCache struct {
 	cache *maxminddb.Metadata
 }
 
-var mcache = &metaCache{}
+var (
+	mcache     = &metaCache{}
+	asnMcache  = &metaCache{}
+	anonMcache = &metaCache{}
+	ispMcache  = &metaCache{}
+	connMcache = &metaCache{}
+)
+
+var errDBNotLoaded = errors.New("database not loaded")
+
+// load opens and verifies the database from disk, and atomically swaps it in
+// as the active reader. If the database fails to load, the previous reader
+// (if any) continues to be used.
+func (d *DB) load() error {
+	buf, mtime, etag, err := d.read()
+	if err != nil {
+		return err
+	}
+
+	// Remote databases are only fetched if they have changed.
+	if buf == nil {
+		return nil
+	}
+
+	reader, err := geoip.FromBytes(buf, d.vendor)
+	if err != nil {
+		return err
+	}
+
+	if d.check != nil {
+		if err = d.check(reader); err != nil {
+			reader.Close()
+			return err
+		}
+	}
+
+	// Lookups hold a read lock for the duration of the lookup, so once the
+	// write lock is acquired, nothing can still be using the old reader.
+	d.mu.Lock()
+	old := d.reader
+	d.reader = reader
+	d.mtime = mtime
+	d.etag = etag
+	d.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	meta := reader.Metadata()
+
+	d.meta.Lock()
+	d.meta.cache = meta
+	d.meta.Unlock()
+
+	logger.Printf("loaded database %q (type: %s, build: %d)", displayPath(d.path), meta.DatabaseType, meta.BuildEpoch)
+	return nil
+}
+
+// open loads the database, retrying with backoff until it succeeds, or
+// timeout has elapsed, in which case the last error is returned. This allows
+// the database to be provisioned shortly after startup.
+func (d *DB) open(timeout time.Duration) error {
+	const maxBackoff = 30 * time.Second
+
+	deadline := time.Now().Add(timeout)
+	backoff := time.Second
+
+	for {
+		// The database may have also been loaded by the watcher meanwhile.
+		if d.loaded() {
+			return nil
+		}
+
+		err := d.load()
+		if err == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+
+		if backoff > remaining {
+			backoff = remaining
+		}
+
+		logger.Printf("unable to open database %q (retrying in %s): %s", displayPath(d.path), backoff.Round(time.Millisecond), err)
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// read reads the database from disk, or fetches it if the path is a remote
+// url. If the remote database is unchanged since it was last fetched, buf is
+// nil.
+func (d *DB) read() (buf []byte, mtime time.Time, etag string, err error) {
+	if isRemotePath(d.path) {
+		d.mu.RLock()
+		etag, mtime = d.etag, d.mtime
+		d.mu.RUnlock()
+
+		var obj *remoteObject
+
+		err = downloadBreaker.call(func() (err error) {
+			obj, err = fetchRemote(d.path, etag, mtime)
+			return err
+		})
+		if err != nil || obj.unchanged {
+			return nil, time.Time{}, "", err
+		}
+
+		return obj.buf, obj.modified, obj.etag, nil
+	}
+
+	stat, err := os.Stat(d.path)
+	if err != nil {
+		return nil, time.Time{}, "", err
+	}
+
+	// The database is read fully into memory (rather than memory mapped), so
+	// the active reader is unaffected if the file is modified in place.
+	buf, err = ioutil.ReadFile(d.path)
+	if err != nil {
+		return nil, time.Time{}, "", err
+	}
+
+	return buf, stat.ModTime(), "", nil
+}
+
+// loaded returns true if the database has been successfully loaded.
+func (d *DB) loaded() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.reader != nil
+}
+
+// Lookup looks up addr in the active database, decoding the record into
+// result. This is only supported by mmdb formatted databases (the optional
+// ASN/anonymous/ISP/connection type databases), as the record is decoded
+// using result's maxminddb struct tags.
+func (d *DB) Lookup(addr net.IP, result interface{}) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.reader == nil {
+		return errDBNotLoaded
+	}
+
+	return d.reader.Decode(addr, result)
+}
+
+// LookupNetwork looks up the geoip record of addr in the active database, and
+// also returns the network of the record which addr matched. ok will be false
+// if addr has no record.
+func (d *DB) LookupNetwork(addr net.IP, record *geoip.Record) (network *net.IPNet, ok bool, err error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.reader == nil {
+		return nil, false, errDBNotLoaded
+	}
+
+	return d.reader.LookupRecord(addr, record)
+}
+
+// redactURL removes any sensitive query parameters (e.g. license keys) from
+// a url, for logging.
+func redactURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "<invalid url>"
+	}
+
+	q := u.Query()
+	if q.Has("license_key") {
+		q.Set("license_key", "redacted")
+		u.RawQuery = q.Encode()
+	}
+
+	return u.Redacted()
+}
+
+// NetworksWithin invokes fn for each network within network which has a
+// record in the active database, until fn returns false.
+// geoip.ErrUnsupported is returned if the format of the database doesn't
+// support iterating over networks.
+func (d *DB) NetworksWithin(network *net.IPNet, fn func(subnet *net.IPNet, record *geoip.Record) bool) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.reader == nil {
+		return errDBNotLoaded
+	}
+
+	return d.reader.NetworksWithin(network, fn)
+}
+
+// watch checks the database file for changes every interval, and reloads
+// it when the modification time changes.
+func (d *DB) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	// Remote databases are re-fetched (if changed) every interval.
+	if isRemotePath(d.path) {
+		for {
+			time.Sleep(interval)
+
+			if err := d.load(); err != nil {
+				logger.Printf("error reloading database %q (continuing to use previous): %s", displayPath(d.path), err)
+			}
+		}
+	}
+
+	var attempted time.Time
+
+	for {
+		time.Sleep(interval)
+
+		stat, err := os.Stat(d.path)
+		if err != nil {
+			continue
+		}
+
+		d.mu.RLock()
+		changed := !stat.ModTime().Equal(d.mtime)
+		d.mu.RUnlock()
+
+		// Only attempt to load each modification once, so a bad database
+		// isn't continuously reloaded.
+		if !changed || stat.ModTime().Equal(attempted) {
+			continue
+		}
+		attempted = stat.ModTime()
+
+		logger.Printf("database %q changed on disk, reloading", d.path)
+		if err = d.load(); err != nil {
+			logger.Printf("error reloading database %q (continuing to use previous): %s", d.path, err)
+		}
+	}
+}
 
 func (d *DB) checkForUpdates() (needsUpdate bool, err error) {
 	curSeconds := time.Now().UnixNano() / int64(time.Second)
@@ -45,17 +310,12 @@ func (d *DB) checkForUpdates() (needsUpdate bool, err error) {
 		return true, err
 	}
 
-	var db *maxminddb.Reader
-
-	db, err = maxminddb.Open(d.path)
-	if err != nil {
-		return true, err
+	if !d.loaded() {
+		if err = d.load(); err != nil {
+			return true, err
+		}
 	}
 
-	mcache.Lock()
-	mcache.cache = &db.Metadata
-	mcache.Unlock()
-
 	if curSeconds-(stat.ModTime().UnixNano()/int64(time.Second)) < 604800 {
 		return false, nil
 	}
@@ -63,11 +323,12 @@ func (d *DB) checkForUpdates() (needsUpdate bool, err error) {
 	return true, nil
 }
 
-func (d *DB) update(url, licenseKey string) error {
+// update downloads the database from src, verifying the archive against
+// hash (if provided), and atomically replaces the active database.
+func (d *DB) update(src *updateSource, hash string) error {
 	started := time.Now()
-	url = fmt.Sprintf(url, licenseKey)
 
-	logger.Printf("fetching new geoip data from: %s", url)
+	logger.Printf("fetching new geoip data from: %s", redactURL(src.url))
 
 	archiveTempFile, err := ioutil.TempFile("", "geoip-archive-")
 	if err != nil {
@@ -97,16 +358,27 @@ func (d *DB) update(url, licenseKey string) error {
 		}
 	}()
 
-	logger.Printf("streaming new database archive to: %q", dbTempFile.Name())
-	resp, err := http.Get(url)
+	logger.Printf("streaming new database archive to: %q", archiveTempFile.Name())
+	resp, err := src.get(src.url)
 	if err != nil {
 		return err
 	}
-	if resp.Body != nil {
-		defer resp.Body.Close()
+	defer resp.Body.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(archiveTempFile, hasher), resp.Body); err != nil {
+		return fmt.Errorf("error downloading database archive: %w", err)
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); hash != "" && sum != hash {
+		return fmt.Errorf("database archive checksum mismatch (expected %s, got %s)", hash, sum)
+	}
+
+	if _, err = archiveTempFile.Seek(0, 0); err != nil {
+		return err
 	}
 
-	gz, err := gzip.NewReader(resp.Body)
+	gz, err := gzip.NewReader(archiveTempFile)
 	if err != nil {
 		return err
 	}
@@ -157,175 +429,361 @@ func (d *DB) update(url, licenseKey string) error {
 		db.Close()
 		return fmt.Errorf("error while attempting to verify geoip data: %s", err)
 	}
-
-	mcache.Lock()
-	mcache.cache = &db.Metadata
-	mcache.Unlock()
 	db.Close()
 
 	logger.Println("verification complete, updating active database")
 
-	file, err := os.Create(d.path)
+	// Write to a temp file in the same directory and rename it over the
+	// active database, so the swap is atomic, and readers with the old
+	// database still open (or mapped) are unaffected.
+	file, err := ioutil.TempFile(filepath.Dir(d.path), ".geoip-db-")
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to create temp file: %s", err)
 	}
 
 	var written int64
 	written, err = io.Copy(file, dbTempFile)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err = os.Chmod(file.Name(), 0o644); err != nil {
+		os.Remove(file.Name())
 		return err
 	}
 
-	logger.Printf("successfully wrote %d bytes to %q (took %s)", written, file.Name(), time.Since(started))
+	if err = os.Rename(file.Name(), d.path); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
 
-	return nil
-}
+	logger.Printf("successfully wrote %d bytes to %q (took %s)", written, d.path, time.Since(started))
 
-// IPSearch is the struct->tag search query to search through the Maxmind DB.
-type IPSearch struct {
-	City struct {
-		Names map[string]string `maxminddb:"names"`
-	} `maxminddb:"city"`
-	Country struct {
-		Code  string            `maxminddb:"iso_code"`
-		Names map[string]string `maxminddb:"names"`
-	} `maxminddb:"country"`
-	Continent struct {
-		Code  string            `maxminddb:"code"`
-		Names map[string]string `maxminddb:"names"`
-	} `maxminddb:"continent"`
-	Location struct {
-		Lat       float64 `maxminddb:"latitude"`
-		Long      float64 `maxminddb:"longitude"`
-		MetroCode int     `maxminddb:"metro_code"`
-		TimeZone  string  `maxminddb:"time_zone"`
-	} `maxminddb:"location"`
-	Postal struct {
-		Code string `maxminddb:"code"`
-	} `maxminddb:"postal"`
-	Subdivisions []struct {
-		Code  string            `maxminddb:"iso_code"`
-		Names map[string]string `maxminddb:"names"`
-	} `maxminddb:"subdivisions"`
-	Traits struct {
-		Proxy bool `maxminddb:"is_anonymous_proxy"`
-	} `maxminddb:"traits"`
+	return d.load()
 }
 
-// AddrResult contains the geolocation and host information for an IP/host.
+// AddrResult contains the geolocation (see geoip.Result) and host information
+// for an IP/host, as returned by the api.
 type AddrResult struct {
-	IP            net.IP  `json:"ip"`
-	Summary       string  `json:"summary"`
-	City          string  `json:"city"`
-	Subdivision   string  `json:"subdivision"`
-	Country       string  `json:"country"`
-	CountryCode   string  `json:"country_abbr"`
-	Continent     string  `json:"continent"`
-	ContinentCode string  `json:"continent_abbr"`
-	Lat           float64 `json:"latitude"`
-	Long          float64 `json:"longitude"`
-	Timezone      string  `json:"timezone"`
-	PostalCode    string  `json:"postal_code"`
-	Proxy         bool    `json:"proxy"`
-	Host          string  `json:"host"`
-	Error         string  `json:"error,omitempty"`
+	XMLName xml.Name `json:"-" xml:"geoip"`
+
+	geoip.Result
+
+	Addresses addressList `json:"addresses,omitempty" xml:"addresses,omitempty"`
+
+	// Only populated for hostnames with both ipv4 and ipv6 addresses, when
+	// requested with "?dualstack=true".
+	IPv4 *familyResult `json:"ipv4,omitempty" xml:"ipv4,omitempty"`
+	IPv6 *familyResult `json:"ipv6,omitempty" xml:"ipv6,omitempty"`
+
+	Host string `json:"host" xml:"host"`
+	// Only populated when requested with "?rdns=true".
+	Hostname *string `json:"hostname,omitempty" xml:"hostname,omitempty"`
+
+	ASN    uint   `json:"autonomous_system_number,omitempty" xml:"autonomous_system_number,omitempty"`
+	ASNOrg string `json:"autonomous_system_organization,omitempty" xml:"autonomous_system_organization,omitempty"`
+
+	// Only populated when the anonymous ip database is loaded, and requested
+	// with "?include=anonymous".
+	IsAnonymous        *bool `json:"is_anonymous,omitempty" xml:"is_anonymous,omitempty"`
+	IsAnonymousVPN     *bool `json:"is_anonymous_vpn,omitempty" xml:"is_anonymous_vpn,omitempty"`
+	IsHostingProvider  *bool `json:"is_hosting_provider,omitempty" xml:"is_hosting_provider,omitempty"`
+	IsPublicProxy      *bool `json:"is_public_proxy,omitempty" xml:"is_public_proxy,omitempty"`
+	IsResidentialProxy *bool `json:"is_residential_proxy,omitempty" xml:"is_residential_proxy,omitempty"`
+	IsTorExitNode      *bool `json:"is_tor_exit_node,omitempty" xml:"is_tor_exit_node,omitempty"`
+
+	// Only populated when the isp and/or connection type databases are
+	// loaded, and requested with "?include=isp,connection".
+	ISP            string `json:"isp,omitempty" xml:"isp,omitempty"`
+	Organization   string `json:"organization,omitempty" xml:"organization,omitempty"`
+	ConnectionType string `json:"connection_type,omitempty" xml:"connection_type,omitempty"`
+
+	// Heuristic, only populated when the asn (or isp) and/or anonymous ip
+	// databases are requested. True if the asn organization is a known
+	// datacenter/hosting provider (see --datacenter-list), or the anonymous ip
+	// database reports a hosting provider.
+	IsDatacenter *bool `json:"is_datacenter,omitempty" xml:"is_datacenter,omitempty"`
+
+	// Warnings about requested optional databases which couldn't be merged
+	// into the result (e.g. because they aren't loaded).
+	Warnings warningList `json:"warnings,omitempty" xml:"warnings,omitempty"`
+
+	Error  string `json:"error,omitempty" xml:"error,omitempty"`
+	Reason string `json:"reason,omitempty" xml:"reason,omitempty"`
+
+	// status and code are the http status code and error code to respond
+	// with for errors, if they shouldn't be returned as a regular result.
+	status int
+	code   errorCode
 }
 
-// addrLookup does a geoip lookup of an IP address. filters is passed into
-// this function, in case there are any long running tasks which the user
-// may not even want (e.g. reverse dns lookups).
-func addrLookup(ctx context.Context, addr net.IP, filters []string) (*AddrResult, error) {
-	var result *AddrResult
-	var err error
+// familyResult is the result of the first address of a single address family
+// of a hostname, which is encoded as an xml element named after the family
+// (rather than <geoip>).
+type familyResult struct {
+	*AddrResult
+}
 
-	db, err := maxminddb.Open(flags.DBPath)
-	if err != nil {
-		return nil, err
-	}
+func (r familyResult) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(r.AddrResult, start)
+}
 
-	var query IPSearch
+// ASNSearch is the struct->tag search query to search through the Maxmind
+// ASN DB.
+type ASNSearch struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
 
-	err = db.Lookup(addr, &query)
-	db.Close()
+// ASNResult contains the autonomous system information for an IP.
+type ASNResult struct {
+	IP           net.IP `json:"ip"`
+	Number       uint   `json:"autonomous_system_number"`
+	Organization string `json:"autonomous_system_organization"`
+	Error        string `json:"error,omitempty"`
+}
 
-	if err != nil {
+// asnLookup does an ASN lookup of an IP address, using the ASN database.
+func asnLookup(addr net.IP) (*ASNResult, error) {
+	var query ASNSearch
+
+	if err := asnDB.Lookup(addr, &query); err != nil {
 		return nil, err
 	}
 
-	result = &AddrResult{
-		IP:            addr,
-		City:          query.City.Names["en"],
-		Country:       query.Country.Names["en"],
-		CountryCode:   query.Country.Code,
-		Continent:     query.Continent.Names["en"],
-		ContinentCode: query.Continent.Code,
-		Lat:           query.Location.Lat,
-		Long:          query.Location.Long,
-		Timezone:      query.Location.TimeZone,
-		PostalCode:    query.Postal.Code,
-		Proxy:         query.Traits.Proxy,
+	result := &ASNResult{
+		IP:           addr,
+		Number:       query.Number,
+		Organization: query.Organization,
 	}
 
-	var subdiv []string
-	for i := 0; i < len(query.Subdivisions); i++ {
-		subdiv = append(subdiv, query.Subdivisions[i].Names["en"])
+	if result.Number == 0 && result.Organization == "" {
+		result.Error = "no results found"
 	}
-	result.Subdivision = strings.Join(subdiv, ", ")
 
-	var summary []string
-	if result.City != "" {
-		summary = append(summary, result.City)
-	}
+	return result, nil
+}
 
-	if result.Subdivision != "" && result.City != result.Subdivision {
-		summary = append(summary, result.Subdivision)
+// newAddrResult builds the result for addr from its database record.
+func newAddrResult(addr net.IP, record *geoip.Record, lang string) *AddrResult {
+	result := &AddrResult{Result: *geoip.NewResult(addr, record, lang, flags.HTTP.LangFallback...)}
+
+	if !result.Found() {
+		result.Error = "no results found"
 	}
 
-	if result.Country != "" && len(summary) == 0 {
-		summary = append(summary, result.Country)
-	} else if result.CountryCode != "" {
-		summary = append(summary, result.CountryCode)
+	return result
+}
+
+// AnonymousResult contains the anonymity information for an IP, from the
+// Maxmind Anonymous IP DB. It also doubles as the search query.
+type AnonymousResult struct {
+	IP                 net.IP `json:"ip" maxminddb:"-"`
+	IsAnonymous        bool   `json:"is_anonymous" maxminddb:"is_anonymous"`
+	IsAnonymousVPN     bool   `json:"is_anonymous_vpn" maxminddb:"is_anonymous_vpn"`
+	IsHostingProvider  bool   `json:"is_hosting_provider" maxminddb:"is_hosting_provider"`
+	IsPublicProxy      bool   `json:"is_public_proxy" maxminddb:"is_public_proxy"`
+	IsResidentialProxy bool   `json:"is_residential_proxy" maxminddb:"is_residential_proxy"`
+	IsTorExitNode      bool   `json:"is_tor_exit_node" maxminddb:"is_tor_exit_node"`
+	Error              string `json:"error,omitempty" maxminddb:"-"`
+}
+
+// anonLookup does a lookup of an IP address in the anonymous IP database.
+// Addresses not in the database are not anonymous.
+func anonLookup(addr net.IP) (*AnonymousResult, error) {
+	result := &AnonymousResult{}
+
+	if err := anonDB.Lookup(addr, result); err != nil {
+		return nil, err
 	}
 
-	if result.Continent != "" && len(summary) == 0 {
-		summary = append(summary, result.Continent)
-	} else if result.ContinentCode != "" && result.Subdivision == "" && result.City == "" {
-		summary = append(summary, result.ContinentCode)
+	result.IP = addr
+	return result, nil
+}
+
+// ISPResult contains the isp and organization information for an IP, from
+// the Maxmind ISP DB. It also doubles as the search query.
+type ISPResult struct {
+	IP                net.IP `json:"ip" maxminddb:"-"`
+	ISP               string `json:"isp" maxminddb:"isp"`
+	Organization      string `json:"organization" maxminddb:"organization"`
+	ASN               uint   `json:"autonomous_system_number" maxminddb:"autonomous_system_number"`
+	ASNOrg            string `json:"autonomous_system_organization" maxminddb:"autonomous_system_organization"`
+	MobileCountryCode string `json:"mobile_country_code,omitempty" maxminddb:"mobile_country_code"`
+	MobileNetworkCode string `json:"mobile_network_code,omitempty" maxminddb:"mobile_network_code"`
+
+	// Only populated when the connection type database is loaded.
+	ConnectionType string `json:"connection_type,omitempty" maxminddb:"-"`
+
+	Error string `json:"error,omitempty" maxminddb:"-"`
+}
+
+// ispLookup does a lookup of an IP address in the ISP database.
+func ispLookup(addr net.IP) (*ISPResult, error) {
+	result := &ISPResult{}
+
+	if err := ispDB.Lookup(addr, result); err != nil {
+		return nil, err
 	}
 
-	result.Summary = strings.Join(summary, ", ")
+	result.IP = addr
 
-	if result.Summary == "" {
+	if result.ISP == "" && result.Organization == "" && result.ASN == 0 {
 		result.Error = "no results found"
 	}
 
-	wantsHosts := len(filters) == 0
-	if !wantsHosts {
-		for i := 0; i < len(filters); i++ {
-			if filters[i] == "host" {
-				wantsHosts = true
-				break
-			}
+	return result, nil
+}
+
+// ConnectionTypeSearch is the struct->tag search query to search through the
+// Maxmind Connection-Type DB.
+type ConnectionTypeSearch struct {
+	// One of "Dialup", "Cable/DSL", "Corporate", "Cellular" or "Satellite".
+	ConnectionType string `maxminddb:"connection_type"`
+}
+
+// connTypeLookup returns the connection type of an IP address, using the
+// connection type database. An empty string is returned if it is unknown.
+func connTypeLookup(addr net.IP) (string, error) {
+	var query ConnectionTypeSearch
+
+	if err := connDB.Lookup(addr, &query); err != nil {
+		return "", err
+	}
+
+	return query.ConnectionType, nil
+}
+
+// networkLookup returns the geoip results of each distinct network block
+// within network, up to max results. If there were more than max results,
+// truncated will be true.
+func networkLookup(network *net.IPNet, max int, lang string) (results []*AddrResult, truncated bool, err error) {
+	err = db.NetworksWithin(network, func(subnet *net.IPNet, record *geoip.Record) bool {
+		if len(results) >= max {
+			truncated = true
+			return false
 		}
+
+		// If network is narrower than the database network block it falls
+		// within, the returned subnet isn't masked to the block.
+		subnet.IP = subnet.IP.Mask(subnet.Mask)
+
+		result := newAddrResult(subnet.IP, record, lang)
+		network := subnet.String()
+		result.Network = &network
+		results = append(results, result)
+		return true
+	})
+
+	return results, truncated, err
+}
+
+// addrLookup does a geoip lookup of an IP address. opts.filters is passed
+// into this function, in case there are any long running tasks which the user
+// may not even want (e.g. reverse dns lookups).
+func addrLookup(ctx context.Context, addr net.IP, opts lookupOptions) (*AddrResult, error) {
+	var err error
+	var record geoip.Record
+	var network *net.IPNet
+	var found bool
+
+	// The attributes are only built when tracing, as dbType takes a lock.
+	var attrs []attribute.KeyValue
+	if tracingEnabled {
+		attrs = append(attrs, attribute.String("geoip.db_type", dbType()))
+	}
+
+	started := time.Now()
+	_, span := startSpan(ctx, "maxmind.lookup", attrs...)
+	network, found, err = db.LookupNetwork(addr, &record)
+	endSpan(span, err)
+	addTiming(ctx, "db", started)
+	if err != nil {
+		return nil, err
 	}
 
-	if wantsHosts {
-		result.Host, _ = lookupHost(ctx, addr)
+	result := newAddrResult(addr, &record, opts.lang)
+
+	// The network of the matched record, which is shared by all addresses
+	// with the same result.
+	if found {
+		prefix := network.String()
+		result.Network = &prefix
+	}
+
+	wantsHosts := len(opts.filters) == 0 || opts.rdns
+	for i := 0; i < len(opts.filters) && !wantsHosts; i++ {
+		wantsHosts = opts.filters[i] == "host"
 	}
 
+	// Databases are merged before rdns, so rdns enrichment rules can depend
+	// on the ASN.
+	if len(opts.include) > 0 {
+		started = time.Now()
+		enrich(result, addr, opts.include)
+		addTiming(ctx, "enrich", started)
+	}
+
+	if wantsHosts && shouldEnrich("rdns", result) {
+		started = time.Now()
+		host, err := lookupHost(ctx, addr)
+		addTiming(ctx, "rdns", started)
+
+		result.Host = host
+
+		// hostname is left null if the lookup failed (e.g. timed out, or the
+		// breaker is open), or there is no PTR record.
+		if opts.rdns && err == nil && host != "" {
+			result.Hostname = &host
+		}
+	}
 	return result, nil
 }
 
+// lookupHost does a reverse (PTR) lookup of addr, returning the first name.
+// Results (including failures) are cached, to prevent hammering resolvers.
+// It must only be called through addrLookup, so the rdns enrichment rules
+// (--http.enrich-rule) are applied.
 func lookupHost(ctx context.Context, addr net.IP) (string, error) {
+	if cached, err := ptrCache.GetIFPresent(addr.String()); err == nil {
+		return cached.(string), nil
+	}
+
+	// If the resolver is failing, results are returned without the hostname,
+	// rather than waiting for each lookup to time out.
+	probe, ok := rdnsBreaker.allow()
+	if !ok {
+		return "", errBreakerOpen
+	}
+
 	dnsCtx, cancel := context.WithTimeout(ctx, flags.DNS.Timeout)
 	defer cancel()
 
 	var names []string
 	var err error
+	var host string
 
 	if names, err = resolver.LookupAddr(dnsCtx, addr.String()); err == nil && len(names) > 0 {
-		return strings.TrimSuffix(names[0], "."), nil
+		host = strings.TrimSuffix(names[0], ".")
+	}
+
+	// Don't cache if the request itself was cancelled, as the lookup may not
+	// have been given a chance to complete.
+	if ctx.Err() != nil {
+		rdnsBreaker.cancel(probe)
+		return host, err
 	}
 
-	return "", err
+	// Addresses without a PTR record are a valid answer, rather than a
+	// failure of the resolver.
+	var dnsErr *net.DNSError
+	rdnsBreaker.done(probe, err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound))
+
+	_ = ptrCache.Set(addr.String(), host)
+
+	return host, err
 }
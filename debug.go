@@ -0,0 +1,80 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/lrstanley/geoip/geoip"
+)
+
+// apiDebugRecord returns the raw record of an address, exactly as stored in
+// the database (including fields which aren't part of lookup results), to
+// help diagnose whether an issue is with the data or the normalization of
+// it. "?db=<name>" selects one of the optional databases (e.g. asn), rather
+// than the geoip database. Only routed with --debug.
+func apiDebugRecord(w http.ResponseWriter, r *http.Request) {
+	addr := net.ParseIP(strings.TrimSpace(chi.URLParam(r, "ip")))
+	if addr == nil {
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "invalid ip address specified: %s", chi.URLParam(r, "ip"))
+		return
+	}
+
+	src := db
+	if name := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("db"))); name != "" {
+		var known bool
+		src = nil
+		for _, e := range enrichments {
+			if e.name == name {
+				known, src = true, e.db()
+				break
+			}
+		}
+
+		if !known {
+			errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "unknown database: %s", name)
+			return
+		}
+
+		if src == nil {
+			errorResponse(w, r, http.StatusNotImplemented, errCodeNotImplemented, "%s database not configured", name)
+			return
+		}
+	}
+
+	var record map[string]interface{}
+	err := src.Lookup(addr, &record)
+	switch {
+	case errors.Is(err, geoip.ErrUnsupported):
+		errorResponse(w, r, http.StatusNotImplemented, errCodeNotImplemented, "raw records are %s", err)
+		return
+	case errors.Is(err, errDBNotLoaded):
+		errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "%s", err)
+		return
+	case err != nil:
+		logger.Printf("error decoding raw record of %q: %s", addr, err)
+		errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "unable to query database")
+		return
+	case len(record) == 0:
+		errorResponse(w, r, http.StatusNotFound, errCodeNotFound, "no record found for %s", addr)
+		return
+	}
+
+	// Always pretty-printed, as this is intended to be read by a human.
+	b, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		logger.Printf("error during json encode for %s: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(b, '\n'))
+}
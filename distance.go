@@ -0,0 +1,94 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+)
+
+// earthRadius is the mean radius of the earth, in meters.
+const earthRadius = 6371008.8
+
+// DistanceResult contains the distance between two addresses.
+type DistanceResult struct {
+	From       *AddrResult `json:"from"`
+	To         *AddrResult `json:"to"`
+	Meters     float64     `json:"meters"`
+	Kilometers float64     `json:"kilometers"`
+}
+
+// haversine returns the great-circle distance between two coordinates, in
+// meters.
+func haversine(lat1, long1, lat2, long2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLong := toRad(long2 - long1)
+
+	a := math.Pow(math.Sin(dLat/2), 2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Pow(math.Sin(dLong/2), 2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func apiDistance(w http.ResponseWriter, r *http.Request) {
+	sides := [2]string{"from", "to"}
+	var addrs [2]string
+	var results [2]*AddrResult
+
+	for i, side := range sides {
+		if addrs[i] = strings.TrimSpace(r.FormValue(side)); addrs[i] == "" {
+			errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "missing %q address", side)
+			return
+		}
+	}
+
+	opts := newLookupOptions(w, r)
+	opts.include = nil // Only location data is needed.
+	opts.filters = []string{"latitude", "longitude"}
+
+	for i, side := range sides {
+		result, _, err := lookupAddr(r.Context(), addrs[i], opts)
+		if err != nil {
+			errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "unable to query database")
+			return
+		}
+
+		if result.IP == nil {
+			status := result.status
+			if status == 0 {
+				status = http.StatusBadRequest
+			}
+
+			errorResponse(w, r, status, result.code, "%q address: %s", side, result.Error)
+			return
+		}
+
+		if result.Lat == 0 && result.Long == 0 {
+			errorResponse(w, r, http.StatusUnprocessableEntity, errCodeNotFound, "%q address (%s) has no location data", side, result.IP)
+			return
+		}
+
+		results[i] = result
+	}
+
+	// The rate limiter has already counted this request once, however two
+	// lookups are done. Requests with invalid addresses aren't charged for
+	// the second.
+	if !hitLimit(w, r, 1) {
+		return
+	}
+
+	meters := haversine(results[0].Lat, results[0].Long, results[1].Lat, results[1].Long)
+
+	jsonResponse(w, r, &DistanceResult{
+		From:       results[0],
+		To:         results[1],
+		Meters:     math.Round(meters),
+		Kilometers: math.Round(meters/10) / 100,
+	})
+}
@@ -0,0 +1,164 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// enrichment is an optional database, which can be merged into lookup
+// results when requested with "?include=<name>".
+type enrichment struct {
+	name  string
+	db    func() *DB
+	meta  *metaCache
+	merge func(result *AddrResult, addr net.IP) error
+}
+
+// enrichments is the registry of optional databases. They are merged in this
+// order, so e.g. the ASN database takes precedence over the ISP database for
+// ASN information.
+var enrichments = []*enrichment{
+	{name: "asn", db: func() *DB { return asnDB }, meta: asnMcache, merge: mergeASN},
+	{name: "anonymous", db: func() *DB { return anonDB }, meta: anonMcache, merge: mergeAnonymous},
+	{name: "isp", db: func() *DB { return ispDB }, meta: ispMcache, merge: mergeISP},
+	{name: "connection", db: func() *DB { return connDB }, meta: connMcache, merge: mergeConnectionType},
+}
+
+// loaded returns true if the database of the enrichment is configured and
+// loaded.
+func (e *enrichment) loaded() bool {
+	d := e.db()
+	return d != nil && d.loaded()
+}
+
+// maxIncludes is the maximum number of databases which can be requested with
+// "?include=".
+const maxIncludes = 10
+
+// parseInclude parses the "include" query parameter, which is a comma
+// separated list of optional databases to merge into lookup results. The
+// returned names are sorted and de-duplicated, so they can be used as part
+// of the cache key.
+func parseInclude(r *http.Request) (include []string) {
+	seen := make(map[string]bool)
+
+	// Only the query string is used (rather than r.FormValue), as this is
+	// also used by middleware, which must not consume request bodies.
+	for _, name := range strings.Split(r.URL.Query().Get("include"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		include = append(include, name)
+
+		if len(include) >= maxIncludes {
+			break
+		}
+	}
+
+	sort.Strings(include)
+	return include
+}
+
+// enrich merges the results of the requested optional databases into result.
+// Databases which are unknown, not loaded, fail to be queried, or are skipped
+// by --http.enrich-rule are added as warnings, rather than failing the lookup.
+func enrich(result *AddrResult, addr net.IP, include []string) {
+	if len(include) == 0 {
+		return
+	}
+
+	requested := make(map[string]bool, len(include))
+	for i := 0; i < len(include); i++ {
+		requested[include[i]] = true
+	}
+
+	for _, e := range enrichments {
+		if !requested[e.name] {
+			continue
+		}
+		delete(requested, e.name)
+
+		if !shouldEnrich(e.name, result) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s skipped by enrichment rules", e.name))
+			continue
+		}
+
+		if !e.loaded() {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s database not loaded", e.name))
+			continue
+		}
+
+		if err := e.merge(result, addr); err != nil {
+			logger.Printf("error looking up %s for %q: %s", e.name, addr, err)
+			result.Warnings = append(result.Warnings, fmt.Sprintf("unable to query %s database", e.name))
+		}
+	}
+
+	for i := 0; i < len(include); i++ {
+		if requested[include[i]] {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("unknown database: %s", include[i]))
+		}
+	}
+
+	result.IsDatacenter = isDatacenter(result)
+}
+
+func mergeASN(result *AddrResult, addr net.IP) error {
+	asn, err := asnLookup(addr)
+	if err != nil {
+		return err
+	}
+
+	result.ASN = asn.Number
+	result.ASNOrg = asn.Organization
+	return nil
+}
+
+func mergeAnonymous(result *AddrResult, addr net.IP) error {
+	anon, err := anonLookup(addr)
+	if err != nil {
+		return err
+	}
+
+	result.IsAnonymous = &anon.IsAnonymous
+	result.IsAnonymousVPN = &anon.IsAnonymousVPN
+	result.IsHostingProvider = &anon.IsHostingProvider
+	result.IsPublicProxy = &anon.IsPublicProxy
+	result.IsResidentialProxy = &anon.IsResidentialProxy
+	result.IsTorExitNode = &anon.IsTorExitNode
+	return nil
+}
+
+// mergeISP merges in the isp information. The ISP database is a superset of
+// the ASN database, so its ASN information is used if the ASN database
+// wasn't also requested.
+func mergeISP(result *AddrResult, addr net.IP) error {
+	isp, err := ispLookup(addr)
+	if err != nil {
+		return err
+	}
+
+	result.ISP = isp.ISP
+	result.Organization = isp.Organization
+
+	if result.ASN == 0 && result.ASNOrg == "" {
+		result.ASN = isp.ASN
+		result.ASNOrg = isp.ASNOrg
+	}
+	return nil
+}
+
+func mergeConnectionType(result *AddrResult, addr net.IP) (err error) {
+	result.ConnectionType, err = connTypeLookup(addr)
+	return err
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// enrichRule is a condition which must be met by a lookup result before an
+// enrichment (rdns, or an optional database) is done for it, configured with
+// --http.enrich-rule, in "<enrichment>:<condition>" form. Supported
+// conditions are:
+//
+//	country=US,CA   only if the country is one of the provided countries.
+//	country!=US,CA  only if the country is not one of the provided countries.
+//	asn             only if the ASN is known.
+//	!asn            only if the ASN is not known.
+//
+// The ASN is only known if the asn database has already been merged into the
+// result (it is merged first, and rdns is done after all databases).
+type enrichRule struct {
+	target    string
+	negate    bool
+	countries map[string]bool // nil for ASN presence conditions.
+}
+
+// enrichRules are the rules of each enrichment. All rules of an enrichment
+// must match for it to be done.
+var enrichRules map[string][]*enrichRule
+
+// loadEnrichRules parses and validates the provided rules.
+func loadEnrichRules(rules []string) error {
+	enrichRules = make(map[string][]*enrichRule)
+
+	for _, raw := range rules {
+		rule, err := parseEnrichRule(raw)
+		if err != nil {
+			return fmt.Errorf("invalid rule %q: %w", raw, err)
+		}
+
+		enrichRules[rule.target] = append(enrichRules[rule.target], rule)
+	}
+
+	return nil
+}
+
+func parseEnrichRule(raw string) (*enrichRule, error) {
+	target, cond, ok := strings.Cut(strings.TrimSpace(raw), ":")
+	if !ok || cond == "" {
+		return nil, fmt.Errorf("expected <enrichment>:<condition>")
+	}
+
+	rule := &enrichRule{target: strings.ToLower(target)}
+
+	known := rule.target == "rdns"
+	for _, e := range enrichments {
+		known = known || e.name == rule.target
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown enrichment %q", target)
+	}
+
+	cond = strings.ToLower(strings.TrimSpace(cond))
+	switch {
+	case cond == "asn" || cond == "!asn":
+		rule.negate = cond == "!asn"
+		return rule, nil
+	case strings.HasPrefix(cond, "country!="):
+		rule.negate = true
+		cond = strings.TrimPrefix(cond, "country!=")
+	case strings.HasPrefix(cond, "country="):
+		cond = strings.TrimPrefix(cond, "country=")
+	default:
+		return nil, fmt.Errorf("unknown condition %q", cond)
+	}
+
+	rule.countries = make(map[string]bool)
+	for _, code := range strings.Split(cond, ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			rule.countries[strings.ToUpper(code)] = true
+		}
+	}
+
+	if len(rule.countries) == 0 {
+		return nil, fmt.Errorf("no countries provided")
+	}
+
+	return rule, nil
+}
+
+// match returns true if result meets the condition of the rule.
+func (rule *enrichRule) match(result *AddrResult) bool {
+	if rule.countries == nil {
+		return (result.ASN != 0) != rule.negate
+	}
+
+	return rule.countries[result.CountryCode] != rule.negate
+}
+
+// shouldEnrich returns true if all rules (if any) of the provided enrichment
+// match result.
+func shouldEnrich(name string, result *AddrResult) bool {
+	for _, rule := range enrichRules[name] {
+		if !rule.match(result) {
+			return false
+		}
+	}
+
+	return true
+}
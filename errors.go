@@ -0,0 +1,124 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// errorCode is the numeric code of an api error. Codes are stable, so
+// clients can rely on them (unlike the message). Each code also has a
+// reason, a short name of the code.
+type errorCode int
+
+const (
+	errCodeInvalidIP        errorCode = 1001 // invalid_ip
+	errCodeNotFound         errorCode = 1002 // not_found
+	errCodeReservedRange    errorCode = 1003 // reserved_range
+	errCodeRateLimited      errorCode = 1004 // rate_limited
+	errCodeDBUnavailable    errorCode = 1005 // db_unavailable
+	errCodeInvalidRequest   errorCode = 1006 // invalid_request
+	errCodeHostnameDisabled errorCode = 1007 // hostname_disabled
+	errCodeUnresolvable     errorCode = 1008 // unresolvable_host
+	errCodeUnknownEndpoint  errorCode = 1009 // unknown_endpoint
+	errCodeTooLarge         errorCode = 1010 // payload_too_large
+	errCodeUnauthorized     errorCode = 1011 // unauthorized
+	errCodeNotImplemented   errorCode = 1012 // not_implemented
+	errCodeTimeout          errorCode = 1013 // timeout
+	errCodeInternal         errorCode = 1014 // internal_error
+	errCodeOverloaded       errorCode = 1015 // overloaded
+)
+
+var errorReasons = map[errorCode]string{
+	errCodeInvalidIP:        "invalid_ip",
+	errCodeNotFound:         "not_found",
+	errCodeReservedRange:    "reserved_range",
+	errCodeRateLimited:      "rate_limited",
+	errCodeDBUnavailable:    "db_unavailable",
+	errCodeInvalidRequest:   "invalid_request",
+	errCodeHostnameDisabled: "hostname_disabled",
+	errCodeUnresolvable:     "unresolvable_host",
+	errCodeUnknownEndpoint:  "unknown_endpoint",
+	errCodeTooLarge:         "payload_too_large",
+	errCodeUnauthorized:     "unauthorized",
+	errCodeNotImplemented:   "not_implemented",
+	errCodeTimeout:          "timeout",
+	errCodeInternal:         "internal_error",
+	errCodeOverloaded:       "overloaded",
+}
+
+// reason returns the reason (short name) of the code.
+func (c errorCode) reason() string {
+	return errorReasons[c]
+}
+
+// APIError describes why a request failed.
+type APIError struct {
+	Code      errorCode `json:"code" xml:"code"`
+	Reason    string    `json:"reason" xml:"reason"`
+	Message   string    `json:"message" xml:"message"`
+	RequestID string    `json:"request_id,omitempty" xml:"request_id,omitempty"`
+}
+
+// ErrorResult is the response body of a failed request.
+type ErrorResult struct {
+	XMLName xml.Name  `json:"-" xml:"geoip"`
+	Error   *APIError `json:"error" xml:"error"`
+}
+
+// newAPIError returns an APIError for the request, including the request id
+// (if any).
+func newAPIError(r *http.Request, code errorCode, format string, args ...interface{}) *APIError {
+	return &APIError{
+		Code:      code,
+		Reason:    code.reason(),
+		Message:   fmt.Sprintf(format, args...),
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+}
+
+// errorResponse responds to the client with an error, in the format they
+// requested (json, xml or plain text).
+func errorResponse(w http.ResponseWriter, r *http.Request, status int, code errorCode, format string, args ...interface{}) {
+	apiErr := newAPIError(r, code, format, args...)
+	writeError(w, r, status, apiErr, &ErrorResult{Error: apiErr})
+}
+
+// writeError writes v (the body of an error response, which must contain
+// apiErr) to the client, in the format they requested. Plain text clients
+// only receive the message.
+func writeError(w http.ResponseWriter, r *http.Request, status int, apiErr *APIError, v interface{}) {
+	switch responseFormat(r) {
+	case formatXML:
+		xmlResponse(w, r, status, v)
+		return
+	case formatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "error: %s\n", apiErr.Message)
+		return
+	}
+
+	// An invalid callback is itself reported as an error, so it can't be
+	// used to wrap the response.
+	if callback := r.FormValue("callback"); callback == "" || reCallback.MatchString(callback) {
+		jsonStatusResponse(w, r, status, v)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if prettyPrint(r) {
+		enc.SetIndent("", "  ")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/lrstanley/geoip/geoip"
+)
+
+// maxFields is the maximum number of field selections allowed in a single
+// request.
+const maxFields = 50
+
+// parseFields parses the "fields" query parameter, which is a comma separated
+// list of dotted json paths (e.g. "country_abbr,location.latitude"). If
+// strict mode is requested, an error is returned for any paths which do not
+// exist on the result type v.
+func parseFields(r *http.Request, v interface{}) (fields []string, err error) {
+	raw := strings.TrimSpace(r.FormValue("fields"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	for _, field := range strings.Split(raw, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	if len(fields) > maxFields {
+		return nil, fmt.Errorf("too many fields supplied (max: %d)", maxFields)
+	}
+
+	if strict := strings.ToLower(r.FormValue("strict")); strict == "true" || strict == "1" {
+		rt := reflect.TypeOf(v)
+		for i := 0; i < len(fields); i++ {
+			if !geoip.FieldExists(rt, strings.Split(fields[i], ".")) {
+				return nil, fmt.Errorf("unknown field: %s", fields[i])
+			}
+		}
+	}
+
+	return fields, nil
+}
+
+// topLevelFields returns the distinct first path segment of each field, in
+// the order they were supplied.
+func topLevelFields(fields []string) (out []string) {
+	seen := make(map[string]bool, len(fields))
+
+	for i := 0; i < len(fields); i++ {
+		name := strings.SplitN(fields[i], ".", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// fieldStyleLegacy is the --http.field-style which renames the fields of
+// json lookup responses. The maxmind style uses the default names, which are
+// already flat, so the flat style is an alias of it.
+const fieldStyleLegacy = "legacy"
+
+// legacyAliases are the names of top-level fields in the legacy style, which
+// match the api geoip replaced. Any other field is converted to camelCase.
+var legacyAliases = map[string]string{
+	"ip":                             "query",
+	"country_abbr":                   "countryCode",
+	"region":                         "regionName",
+	"region_abbr":                    "region",
+	"continent_abbr":                 "continentCode",
+	"latitude":                       "lat",
+	"longitude":                      "lon",
+	"postal_code":                    "zip",
+	"utc_offset":                     "offset",
+	"organization":                   "org",
+	"autonomous_system_number":       "asn",
+	"autonomous_system_organization": "asname",
+	"hostname":                       "reverse",
+}
+
+// styleFields converts the field names of a lookup response (already
+// filtered with ?fields=, which always uses the default names) to the
+// configured --http.field-style. v is returned as-is with the default style.
+func styleFields(v interface{}) interface{} {
+	if flags.HTTP.FieldStyle != fieldStyleLegacy {
+		return v
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	// Numbers are kept as-is, rather than converted to floats.
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var out interface{}
+	if err = dec.Decode(&out); err != nil {
+		panic(err)
+	}
+
+	return legacyFields(out, true)
+}
+
+// legacyFields renames the fields of all objects within v to the legacy
+// style. Aliases only apply to top-level fields (those of each result in a
+// batch), so e.g. the name of a subdivision isn't renamed to regionName.
+func legacyFields(v interface{}, top bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			name, ok := legacyAliases[key]
+			if !ok || !top {
+				name = camelCase(key)
+			}
+
+			out[name] = legacyFields(value, false)
+		}
+		return out
+	case []interface{}:
+		for i := range v {
+			v[i] = legacyFields(v[i], top)
+		}
+	}
+
+	return v
+}
+
+// camelCase converts a snake_case name to camelCase.
+func camelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+
+	return strings.Join(parts, "")
+}
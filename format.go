@@ -0,0 +1,385 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/lrstanley/geoip/geoip"
+)
+
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatText   = "text"
+	formatNDJSON = "ndjson"
+	formatXML    = "xml"
+)
+
+// extensionFormats are the output formats which can be requested with an
+// extension on the last path segment (e.g. "/api/8.8.8.8.xml").
+var extensionFormats = map[string]string{
+	"json": formatJSON,
+	"xml":  formatXML,
+	"csv":  formatCSV,
+	"txt":  formatText,
+}
+
+type formatKey struct{}
+
+// formatExtension strips a format extension (see extensionFormats) from the
+// last url parameter of the route, e.g. the address of "/api/8.8.8.8.json",
+// and uses it as the output format of the request. Extensions which aren't
+// known are only rejected if the parameter is otherwise an ip or cidr, as
+// hostnames also contain dots.
+func formatExtension(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rctx := chi.RouteContext(r.Context())
+		if rctx == nil || len(rctx.URLParams.Values) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		last := len(rctx.URLParams.Values) - 1
+		value := rctx.URLParams.Values[last]
+
+		i := strings.LastIndex(value, ".")
+		if i < 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if format, ok := extensionFormats[strings.ToLower(value[i+1:])]; ok {
+			rctx.URLParams.Values[last] = value[:i]
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), formatKey{}, format)))
+			return
+		}
+
+		if _, _, err := net.ParseCIDR(value[:i]); err == nil || net.ParseIP(value[:i]) != nil {
+			errorResponse(w, r, http.StatusBadRequest, errCodeInvalidRequest, "unsupported format extension: %s", value[i:])
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseFormat returns the output format requested by the client, either
+// explicitly through a path extension (see formatExtension) or the "format"
+// query parameter, or negotiated through the Accept header. Defaults to JSON.
+func responseFormat(r *http.Request) string {
+	if format, ok := r.Context().Value(formatKey{}).(string); ok {
+		return format
+	}
+
+	if format := strings.ToLower(strings.TrimSpace(r.FormValue("format"))); format != "" {
+		return format
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+
+		if strings.EqualFold(mediaType, "text/csv") {
+			return formatCSV
+		}
+
+		if strings.EqualFold(mediaType, "application/x-ndjson") {
+			return formatNDJSON
+		}
+
+		if strings.EqualFold(mediaType, "application/xml") || strings.EqualFold(mediaType, "text/xml") {
+			return formatXML
+		}
+	}
+
+	return formatJSON
+}
+
+// resultFields returns the json field names of AddrResult (including those
+// promoted from geoip.Result), in the same order they are defined.
+func resultFields() (fields []string) {
+	fields, _ = jsonFields(reflect.TypeOf(AddrResult{}), nil)
+	return fields
+}
+
+// jsonFields returns the json field names of the struct type rt, and the
+// index path of each field (for reflect.Value.FieldByIndex). Fields of
+// embedded structs are promoted.
+func jsonFields(rt reflect.Type, parent []int) (names []string, index [][]int) {
+	for i := 0; i < rt.NumField(); i++ {
+		path := append(append([]int{}, parent...), i)
+		name := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+
+		if name == "" && rt.Field(i).Anonymous {
+			n, idx := jsonFields(rt.Field(i).Type, path)
+			names, index = append(names, n...), append(index, idx...)
+			continue
+		}
+
+		if name == "" || name == "-" {
+			continue
+		}
+
+		names = append(names, name)
+		index = append(index, path)
+	}
+
+	return names, index
+}
+
+// resultValues returns the string representation of each of the requested
+// fields (json field names) of the result.
+func resultValues(result *AddrResult, fields []string) []string {
+	rv := reflect.ValueOf(result).Elem()
+
+	names, paths := jsonFields(rv.Type(), nil)
+	index := make(map[string][]int, len(names))
+	for i := 0; i < len(names); i++ {
+		index[names[i]] = paths[i]
+	}
+
+	values := make([]string, len(fields))
+	for i := 0; i < len(fields); i++ {
+		fi, ok := index[fields[i]]
+		if !ok {
+			continue
+		}
+
+		field := rv.FieldByIndex(fi)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		}
+
+		switch v := field.Interface().(type) {
+		case net.IP:
+			if v != nil {
+				values[i] = v.String()
+			}
+		case string:
+			values[i] = v
+		case float64:
+			values[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case addressList:
+			values[i] = strings.Join(v, " ")
+		case warningList:
+			values[i] = strings.Join(v, "; ")
+		case geoip.LanguageList:
+			values[i] = strings.Join(v, " ")
+		case familyResult:
+			b, _ := json.Marshal(v)
+			values[i] = string(b)
+		case geoip.SubdivisionList:
+			if len(v) > 0 {
+				b, _ := json.Marshal(v)
+				values[i] = string(b)
+			}
+		default:
+			values[i] = fmt.Sprint(v)
+		}
+	}
+
+	return values
+}
+
+// csvResponse writes the results to the client as CSV, with a header row of
+// the field names. If filters are supplied, only those fields are included.
+func csvResponse(w http.ResponseWriter, r *http.Request, results []*AddrResult, filters []string, filename string) {
+	fields := filters
+	if len(fields) == 0 {
+		fields = resultFields()
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write(fields)
+
+	for i := 0; i < len(results); i++ {
+		_ = cw.Write(resultValues(results[i], fields))
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		logger.Printf("error during csv encode for %s: %s", r.RemoteAddr, err)
+	}
+}
+
+// addressList is a list of addresses, which is encoded as a single
+// <addresses> xml element containing an <address> element for each address.
+type addressList []string
+
+func (l addressList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(struct {
+		Items []string `xml:"address"`
+	}{l}, start)
+}
+
+// warningList is a list of warnings, which is encoded as a single <warnings>
+// xml element containing a <warning> element for each warning.
+type warningList []string
+
+func (l warningList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(struct {
+		Items []string `xml:"warning"`
+	}{l}, start)
+}
+
+// prettyPrint returns true if the response should be indented, either when
+// requested with "?pretty=true", or by default for browsers (which accept
+// text/html), so responses are readable when opened directly.
+// "?pretty=false" disables indentation for browsers.
+func prettyPrint(r *http.Request) bool {
+	if pretty := strings.TrimSpace(r.FormValue("pretty")); pretty != "" {
+		ok, _ := strconv.ParseBool(pretty)
+		return ok
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.EqualFold(strings.TrimSpace(strings.SplitN(accept, ";", 2)[0]), "text/html") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// xmlResponse encodes v as xml to the client, with the provided status code,
+// and with indentation if the client has requested it (see prettyPrint).
+func xmlResponse(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	if prettyPrint(r) {
+		enc.Indent("", "  ")
+	}
+
+	if err := enc.Encode(v); err != nil {
+		logger.Printf("error during xml encode for %s: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	buf.WriteString("\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = buf.WriteTo(w)
+}
+
+// textResponse writes a single lookup result as plain text. If field (a dotted
+// json path) is supplied, only the raw value of that field is written,
+// otherwise a multi-line "name: value" summary of all non-empty fields is
+// written.
+func textResponse(w http.ResponseWriter, result *AddrResult, out interface{}, field string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if result.Error != "" {
+		if result.IP == nil {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprintf(w, "error: %s\n", result.Error)
+		return
+	}
+
+	if field == "" {
+		fields := resultFields()
+
+		selected, err := geoip.SelectFields(out, fields)
+		if err != nil {
+			panic(err)
+		}
+
+		values, _ := selected.(map[string]interface{})
+
+		var buf bytes.Buffer
+		for i := 0; i < len(fields); i++ {
+			if text := textValue(values[fields[i]]); text != "" {
+				fmt.Fprintf(&buf, "%s: %s\n", fields[i], text)
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = buf.WriteTo(w)
+		return
+	}
+
+	selected, err := geoip.SelectFields(out, []string{field})
+	if err != nil {
+		panic(err)
+	}
+
+	value := pathValue(selected, strings.Split(field, "."))
+
+	if value == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "error: no value for field: %s\n", field)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, textValue(value))
+}
+
+// pathValue returns the value at path within a decoded json value. Arrays
+// along the path return the value for each element.
+func pathValue(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return v
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return pathValue(val[path[0]], path[1:])
+	case []interface{}:
+		values := make([]interface{}, 0, len(val))
+		for i := 0; i < len(val); i++ {
+			if item := pathValue(val[i], path); item != nil {
+				values = append(values, item)
+			}
+		}
+
+		if len(values) == 0 {
+			return nil
+		}
+		return values
+	}
+
+	return nil
+}
+
+// textValue returns the plain text representation of a decoded json value.
+func textValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
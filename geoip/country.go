@@ -0,0 +1,132 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package geoip
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/language"
+)
+
+// Static country information which isn't included in Maxmind databases, keyed
+// by ISO 3166-1 alpha-2 country code.
+//
+//go:embed data/countries.csv
+var countriesCSV string
+
+type countryDetails struct {
+	currency  string       // ISO 4217 currency code.
+	languages LanguageList // ISO 639-1 language codes.
+}
+
+var (
+	countriesOnce sync.Once
+	countries     map[string]*countryDetails
+)
+
+// countryInfo returns the static information of an ISO 3166-1 alpha-2 country
+// code, or nil if the country is unknown.
+func countryInfo(code string) *countryDetails {
+	countriesOnce.Do(func() {
+		reader := csv.NewReader(strings.NewReader(countriesCSV))
+		reader.Comment = '#'
+
+		records, err := reader.ReadAll()
+		if err != nil {
+			// The table is embedded, so this can only be a build issue.
+			panic(fmt.Sprintf("invalid embedded country table: %s", err))
+		}
+
+		countries = make(map[string]*countryDetails, len(records))
+		for _, record := range records[1:] {
+			countries[record[0]] = &countryDetails{
+				currency:  record[1],
+				languages: strings.Fields(record[2]),
+			}
+		}
+	})
+
+	return countries[strings.ToUpper(code)]
+}
+
+// ISO 3166-2 subdivisions of each country, keyed by ISO 3166-1 alpha-2
+// country code.
+//
+//go:embed data/subdivisions.csv
+var subdivisionsCSV string
+
+var (
+	subdivisionsOnce sync.Once
+	subdivisions     map[string]SubdivisionList
+)
+
+// CountrySubdivisions returns the ISO 3166-2 subdivisions (e.g. states and
+// provinces) of an ISO 3166-1 alpha-2 country code, sorted by code, with
+// their English names. The codes match those of lookup results. nil is
+// returned if the country is unknown, or has no subdivisions.
+func CountrySubdivisions(code string) SubdivisionList {
+	subdivisionsOnce.Do(func() {
+		reader := csv.NewReader(strings.NewReader(subdivisionsCSV))
+		reader.Comment = '#'
+
+		records, err := reader.ReadAll()
+		if err != nil {
+			// The table is embedded, so this can only be a build issue.
+			panic(fmt.Sprintf("invalid embedded subdivision table: %s", err))
+		}
+
+		subdivisions = make(map[string]SubdivisionList)
+		for _, record := range records[1:] {
+			subdivisions[record[0]] = append(subdivisions[record[0]], Subdivision{
+				Code: record[1],
+				Name: record[2],
+			})
+		}
+	})
+
+	return subdivisions[strings.ToUpper(code)]
+}
+
+// countryFlag returns the flag emoji of an ISO 3166-1 alpha-2 country code,
+// which is the code's letters as regional indicator symbols. An empty string
+// is returned if code isn't two letters.
+func countryFlag(code string) string {
+	if len(code) != 2 {
+		return ""
+	}
+
+	code = strings.ToUpper(code)
+
+	var flag strings.Builder
+	for i := 0; i < len(code); i++ {
+		if code[i] < 'A' || code[i] > 'Z' {
+			return ""
+		}
+
+		flag.WriteRune(rune(code[i]-'A') + 0x1F1E6)
+	}
+
+	return flag.String()
+}
+
+// countryNumeric returns the ISO 3166-1 numeric code (e.g. "036" for "AU") of
+// an ISO 3166-1 alpha-2 country code. An empty string is returned if code
+// isn't a known country (including user-assigned codes, e.g. "XK").
+func countryNumeric(code string) string {
+	if code == "" || strings.HasPrefix(strings.ToUpper(code), "X") {
+		return ""
+	}
+
+	region, err := language.ParseRegion(code)
+	if err != nil || !region.IsCountry() || region.M49() == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%03d", region.M49())
+}
@@ -0,0 +1,139 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package geoip
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// FieldExists checks if the json path exists on the provided type.
+func FieldExists(rt reflect.Type, path []string) bool {
+	for rt.Kind() == reflect.Ptr || rt.Kind() == reflect.Slice || rt.Kind() == reflect.Array {
+		if rt.Kind() == reflect.Slice && rt.Elem().Kind() == reflect.Uint8 {
+			break // []byte (e.g. net.IP) is encoded as a scalar.
+		}
+		rt = rt.Elem()
+	}
+
+	if len(path) == 0 {
+		return true
+	}
+
+	switch rt.Kind() {
+	case reflect.Map:
+		return FieldExists(rt.Elem(), path[1:])
+	case reflect.Struct:
+		for i := 0; i < rt.NumField(); i++ {
+			name := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+
+			// Fields of embedded structs are promoted.
+			if name == "" && rt.Field(i).Anonymous && FieldExists(rt.Field(i).Type, path) {
+				return true
+			}
+
+			if name == path[0] {
+				return FieldExists(rt.Field(i).Type, path[1:])
+			}
+		}
+	}
+
+	return false
+}
+
+// SelectFields filters v (after being json encoded) down to only the
+// requested dotted json paths. Paths which do not exist are ignored. If v
+// encodes to a json array, the selection is applied to each element.
+func SelectFields(v interface{}, fields []string) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err = dec.Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	if items, ok := decoded.([]interface{}); ok {
+		for i := 0; i < len(items); i++ {
+			items[i] = selectPaths(items[i], fields)
+		}
+		return items, nil
+	}
+
+	return selectPaths(decoded, fields), nil
+}
+
+func selectPaths(v interface{}, fields []string) interface{} {
+	out := make(map[string]interface{})
+
+	for i := 0; i < len(fields); i++ {
+		selectPath(v, out, strings.Split(fields[i], "."))
+	}
+
+	return out
+}
+
+// selectPath copies the value at path from src into dst, creating any
+// intermediate objects as necessary.
+func selectPath(src interface{}, dst map[string]interface{}, path []string) {
+	m, ok := src.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	val, ok := m[path[0]]
+	if !ok {
+		return
+	}
+
+	if len(path) == 1 {
+		dst[path[0]] = val
+		return
+	}
+
+	switch child := val.(type) {
+	case map[string]interface{}:
+		next, _ := dst[path[0]].(map[string]interface{})
+		if next == nil {
+			next = make(map[string]interface{})
+		}
+
+		selectPath(child, next, path[1:])
+		if len(next) > 0 {
+			dst[path[0]] = next
+		}
+	case []interface{}:
+		// Apply the remaining path to each element of the array.
+		next, _ := dst[path[0]].([]interface{})
+		if next == nil {
+			next = make([]interface{}, len(child))
+		}
+
+		var found bool
+		for i := 0; i < len(child); i++ {
+			item, _ := next[i].(map[string]interface{})
+			if item == nil {
+				item = make(map[string]interface{})
+			}
+
+			selectPath(child[i], item, path[1:])
+			if len(item) > 0 {
+				found = true
+			}
+			next[i] = item
+		}
+
+		if found {
+			dst[path[0]] = next
+		}
+	}
+}
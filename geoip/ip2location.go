@@ -0,0 +1,407 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package geoip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// Column positions of each field, for each IP2Location database type
+// (DB1-DB26). 0 means the database type doesn't include the field.
+var (
+	binCountryPos   = [27]uint8{0, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}
+	binRegionPos    = [27]uint8{0, 0, 0, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3}
+	binCityPos      = [27]uint8{0, 0, 0, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4}
+	binLatitudePos  = [27]uint8{0, 0, 0, 0, 0, 5, 5, 0, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5}
+	binLongitudePos = [27]uint8{0, 0, 0, 0, 0, 6, 6, 0, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6}
+	binZipCodePos   = [27]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 7, 7, 7, 7, 0, 7, 7, 7, 0, 7, 0, 7, 7, 7, 0, 7, 7, 7}
+	binTimeZonePos  = [27]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 8, 8, 7, 8, 8, 8, 7, 8, 0, 8, 8, 8, 0, 8, 8, 8}
+)
+
+// binEUCountries are the member states of the European Union, as IP2Location
+// databases don't include membership.
+var binEUCountries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "CY": true, "CZ": true, "DE": true, "DK": true,
+	"EE": true, "ES": true, "FI": true, "FR": true, "GR": true, "HR": true, "HU": true,
+	"IE": true, "IT": true, "LT": true, "LU": true, "LV": true, "MT": true, "NL": true,
+	"PL": true, "PT": true, "RO": true, "SE": true, "SI": true, "SK": true,
+}
+
+var errBINCorrupt = errors.New("ip2location database is corrupt or truncated")
+
+// binTable is the location of the IPv4 or IPv6 rows within a BIN database.
+type binTable struct {
+	count    uint32
+	base     uint32
+	index    uint32
+	colSize  uint32
+	firstCol uint32 // Size of the ip_from column.
+}
+
+// binReader is the adapter for IP2Location BIN formatted databases. The
+// database is kept in memory, and all offsets within it are bounds checked,
+// so a corrupt database results in errors rather than panics.
+type binReader struct {
+	buf    []byte
+	dbType uint8
+	v4, v6 binTable
+	meta   maxminddb.Metadata
+}
+
+func newBINReader(buf []byte) (*binReader, error) {
+	if len(buf) < 64 {
+		return nil, errors.New("invalid ip2location database (header too short)")
+	}
+
+	r := &binReader{buf: buf, dbType: buf[0]}
+	columns := uint32(buf[1])
+
+	if r.dbType == 0 || int(r.dbType) >= len(binCountryPos) || columns < 2 {
+		return nil, fmt.Errorf("invalid ip2location database (unsupported type: %d)", r.dbType)
+	}
+
+	// 1 is IP2Location, 2 is IP2Proxy (older databases don't set it).
+	if product := buf[29]; product > 1 {
+		return nil, fmt.Errorf("invalid ip2location database (unsupported product code: %d)", product)
+	}
+
+	r.v4 = binTable{
+		count:    binary.LittleEndian.Uint32(buf[5:]),
+		base:     binary.LittleEndian.Uint32(buf[9:]),
+		index:    binary.LittleEndian.Uint32(buf[21:]),
+		colSize:  columns * 4,
+		firstCol: 4,
+	}
+	r.v6 = binTable{
+		count:    binary.LittleEndian.Uint32(buf[13:]),
+		base:     binary.LittleEndian.Uint32(buf[17:]),
+		index:    binary.LittleEndian.Uint32(buf[25:]),
+		colSize:  columns*4 + 12,
+		firstCol: 16,
+	}
+
+	// Make sure the rows (including the trailing row, which holds the end of
+	// the last range) are within the database.
+	for _, t := range []binTable{r.v4, r.v6} {
+		if t.count > 0 && uint64(t.base)+(uint64(t.count)+1)*uint64(t.colSize) > uint64(len(buf))+1 {
+			return nil, errBINCorrupt
+		}
+	}
+
+	built := time.Date(2000+int(buf[2]), time.Month(buf[3]), int(buf[4]), 0, 0, 0, 0, time.UTC)
+
+	r.meta = maxminddb.Metadata{
+		DatabaseType: fmt.Sprintf("IP2Location-DB%d", r.dbType),
+		Description:  map[string]string{"en": fmt.Sprintf("IP2Location DB%d", r.dbType)},
+		BuildEpoch:   uint(built.Unix()),
+		IPVersion:    4,
+		Languages:    []string{"en"},
+	}
+
+	if r.v6.count > 0 {
+		r.meta.IPVersion = 6
+	}
+
+	return r, nil
+}
+
+// uint32At reads a little-endian uint32 at the (1-based) pos.
+func (r *binReader) uint32At(pos uint32) (uint32, error) {
+	if pos == 0 || uint64(pos)+3 > uint64(len(r.buf)) {
+		return 0, errBINCorrupt
+	}
+
+	return binary.LittleEndian.Uint32(r.buf[pos-1:]), nil
+}
+
+// addrAt reads the (little-endian) address at the (1-based) pos.
+func (r *binReader) addrAt(t *binTable, pos uint32) (netip.Addr, error) {
+	if t.firstCol == 4 {
+		n, err := r.uint32At(pos)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], n)
+		return netip.AddrFrom4(b), nil
+	}
+
+	if pos == 0 || uint64(pos)+15 > uint64(len(r.buf)) {
+		return netip.Addr{}, errBINCorrupt
+	}
+
+	var b [16]byte
+	for i := 0; i < 16; i++ {
+		b[i] = r.buf[int(pos)-1+15-i]
+	}
+
+	return netip.AddrFrom16(b), nil
+}
+
+// stringAt reads the length-prefixed string at the (0-based) pos. Unknown
+// values ("-") are returned as an empty string.
+func (r *binReader) stringAt(pos uint32) (string, error) {
+	if uint64(pos) >= uint64(len(r.buf)) {
+		return "", errBINCorrupt
+	}
+
+	end := uint64(pos) + 1 + uint64(r.buf[pos])
+	if end > uint64(len(r.buf)) {
+		return "", errBINCorrupt
+	}
+
+	s := string(r.buf[pos+1 : end])
+	if s == "-" {
+		return "", nil
+	}
+
+	return s, nil
+}
+
+func (r *binReader) lookup(addr net.IP, record *Record) (*net.IPNet, bool, error) {
+	ip, ok := netip.AddrFromSlice(addr)
+	if !ok {
+		return nil, false, nil
+	}
+	ip = ip.Unmap()
+
+	t := &r.v4
+	if !ip.Is4() {
+		t = &r.v6
+	}
+
+	if t.count == 0 {
+		return nil, false, nil
+	}
+
+	// The end of each range is exclusive, so the last address is looked up
+	// as the one before it.
+	search := ip
+	if !ip.Next().IsValid() {
+		search = ip.Prev()
+	}
+
+	low, high := uint32(0), t.count
+	if t.index > 0 {
+		b := search.AsSlice()
+		pos := (uint32(b[0])<<8|uint32(b[1]))<<3 + t.index
+
+		var err error
+		if low, err = r.uint32At(pos); err != nil {
+			return nil, false, err
+		}
+		if high, err = r.uint32At(pos + 4); err != nil {
+			return nil, false, err
+		}
+	}
+
+	for low <= high {
+		mid := low + (high-low)/2
+		row := t.base + mid*t.colSize
+
+		from, err := r.addrAt(t, row)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if search.Less(from) {
+			if mid == 0 {
+				return nil, false, nil
+			}
+			high = mid - 1
+			continue
+		}
+
+		// The trailing row is only read as the end of the last range.
+		to, err := r.addrAt(t, row+t.colSize)
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch {
+		case !search.Less(to):
+			low = mid + 1
+		default:
+			if err = r.decode(t, row, record); err != nil {
+				return nil, false, err
+			}
+
+			// The trailing row of the last range is the last address, which
+			// is part of the range.
+			last := to.Prev()
+			if !to.Next().IsValid() {
+				last = to
+			}
+
+			return rangeNetwork(ip, from, last), true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// decode decodes the row at the (1-based) row offset into record.
+func (r *binReader) decode(t *binTable, row uint32, record *Record) error {
+	field := func(positions *[27]uint8) (uint32, bool, error) {
+		pos := positions[r.dbType]
+		if pos == 0 {
+			return 0, false, nil
+		}
+
+		v, err := r.uint32At(row + t.firstCol + uint32(pos-2)*4)
+		return v, err == nil, err
+	}
+
+	str := func(positions *[27]uint8) (string, error) {
+		ptr, ok, err := field(positions)
+		if !ok {
+			return "", err
+		}
+
+		return r.stringAt(ptr)
+	}
+
+	if ptr, ok, err := field(&binCountryPos); err != nil {
+		return err
+	} else if ok {
+		if record.Country.Code, err = r.stringAt(ptr); err != nil {
+			return err
+		}
+		record.Country.IsInEuropeanUnion = binEUCountries[record.Country.Code]
+
+		name, err := r.stringAt(ptr + 3)
+		if err != nil {
+			return err
+		}
+
+		if name != "" {
+			record.Country.Names = map[string]string{"en": name}
+		}
+	}
+
+	region, err := str(&binRegionPos)
+	if err != nil {
+		return err
+	}
+
+	if region != "" {
+		record.Subdivisions = append(record.Subdivisions, struct {
+			GeoNameID  uint              `maxminddb:"geoname_id"`
+			Code       string            `maxminddb:"iso_code"`
+			Names      map[string]string `maxminddb:"names"`
+			Confidence *uint8            `maxminddb:"confidence"`
+		}{Names: map[string]string{"en": region}})
+	}
+
+	city, err := str(&binCityPos)
+	if err != nil {
+		return err
+	}
+
+	if city != "" {
+		record.City.Names = map[string]string{"en": city}
+	}
+
+	if v, ok, err := field(&binLatitudePos); err != nil {
+		return err
+	} else if ok {
+		record.Location.Lat = binFloat(v)
+	}
+
+	if v, ok, err := field(&binLongitudePos); err != nil {
+		return err
+	} else if ok {
+		record.Location.Long = binFloat(v)
+	}
+
+	if record.Postal.Code, err = str(&binZipCodePos); err != nil {
+		return err
+	}
+
+	// IP2Location only provides the (fixed) offset from UTC, e.g. "-07:00",
+	// rather than an IANA zone.
+	zone, err := str(&binTimeZonePos)
+	if err != nil {
+		return err
+	}
+
+	if offset, ok := parseUTCOffset(zone); ok {
+		record.offset = &offset
+	}
+
+	return nil
+}
+
+// binFloat converts the float32 bits of a coordinate to a float64, without
+// introducing float32 rounding noise (e.g. 37.40599060058594).
+func binFloat(bits uint32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(math.Float32frombits(bits)), 'f', -1, 32), 64)
+	return v
+}
+
+// parseUTCOffset parses a "+hh:mm" offset from UTC, returning it in seconds.
+func parseUTCOffset(raw string) (offset int, ok bool) {
+	if len(raw) != 6 || (raw[0] != '+' && raw[0] != '-') || raw[3] != ':' {
+		return 0, false
+	}
+
+	hours, err := strconv.Atoi(raw[1:3])
+	if err != nil {
+		return 0, false
+	}
+
+	minutes, err := strconv.Atoi(raw[4:6])
+	if err != nil {
+		return 0, false
+	}
+
+	offset = hours*3600 + minutes*60
+	if raw[0] == '-' {
+		offset = -offset
+	}
+
+	return offset, true
+}
+
+// rangeNetwork returns the widest network containing addr, which is within
+// the inclusive range first-last.
+func rangeNetwork(addr, first, last netip.Addr) *net.IPNet {
+	for bits := 0; bits < addr.BitLen(); bits++ {
+		prefix := netip.PrefixFrom(addr, bits).Masked()
+		if prefix.Addr().Compare(first) >= 0 && LastAddr(prefix).Compare(last) <= 0 {
+			return &net.IPNet{
+				IP:   net.IP(prefix.Addr().AsSlice()),
+				Mask: net.CIDRMask(bits, addr.BitLen()),
+			}
+		}
+	}
+
+	return &net.IPNet{
+		IP:   net.IP(addr.AsSlice()),
+		Mask: net.CIDRMask(addr.BitLen(), addr.BitLen()),
+	}
+}
+
+func (r *binReader) networksWithin(*net.IPNet, func(*net.IPNet, *Record) bool) error {
+	return ErrUnsupported
+}
+
+func (r *binReader) metadata() *maxminddb.Metadata {
+	return &r.meta
+}
+
+func (r *binReader) close() error {
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package geoip
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// binRow is a row of a synthetic IPv4 BIN database. Empty strings are
+// written as "-" (unknown).
+type binRow struct {
+	from                string
+	country, name       string
+	region, city        string
+	latitude, longitude float32
+}
+
+// buildBIN builds an IPv4-only BIN database of dbType (1 or 5) from rows,
+// which must be sorted. A trailing row holding the end of the last range
+// (255.255.255.255) is added, and the strings follow the rows.
+func buildBIN(t *testing.T, dbType uint8, rows []binRow) []byte {
+	t.Helper()
+
+	columns := uint32(2)
+	if dbType == 5 {
+		columns = 6
+	}
+
+	const base = 65 // The rows follow the 64 byte header (1-based).
+	colSize := columns * 4
+
+	buf := make([]byte, 64+(len(rows)+1)*int(colSize))
+	buf[0], buf[1] = dbType, uint8(columns)
+	buf[2], buf[3], buf[4] = 24, 6, 1
+	binary.LittleEndian.PutUint32(buf[5:], uint32(len(rows)))
+	binary.LittleEndian.PutUint32(buf[9:], base)
+
+	str := func(s string) uint32 {
+		if s == "" {
+			s = "-"
+		}
+
+		ptr := uint32(len(buf))
+		buf = append(buf, uint8(len(s)))
+		buf = append(buf, s...)
+		return ptr
+	}
+
+	// The country name is read 3 bytes after the code, so unknown ("-")
+	// codes are padded.
+	country := func(code, name string) uint32 {
+		ptr := str(code)
+		if code == "" {
+			buf = append(buf, 0)
+		}
+
+		str(name)
+		return ptr
+	}
+
+	for i, row := range rows {
+		addr := netip.MustParseAddr(row.from).As4()
+		cols := []uint32{binary.BigEndian.Uint32(addr[:]), country(row.country, row.name)}
+
+		if dbType == 5 {
+			cols = append(cols,
+				str(row.region),
+				str(row.city),
+				math.Float32bits(row.latitude),
+				math.Float32bits(row.longitude),
+			)
+		}
+
+		offset := base - 1 + i*int(colSize)
+		for j, v := range cols {
+			binary.LittleEndian.PutUint32(buf[offset+j*4:], v)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(buf[base-1+len(rows)*int(colSize):], math.MaxUint32)
+	return buf
+}
+
+func TestBINLookup(t *testing.T) {
+	db1 := buildBIN(t, 1, []binRow{
+		{from: "0.0.0.0", country: "US", name: "United States of America"},
+		{from: "10.0.0.0"},
+		{from: "20.0.0.0", country: "DE", name: "Germany"},
+	})
+
+	db5 := buildBIN(t, 5, []binRow{
+		{from: "1.0.0.0"},
+		{
+			from: "8.8.8.0", country: "US", name: "United States of America",
+			region: "California", city: "Mountain View", latitude: 37.405992, longitude: -122.078515,
+		},
+		{from: "8.8.9.0"},
+		{from: "9.0.0.0", country: "FR", name: "France", region: "Ile-de-France", city: "Paris", latitude: 48.85341, longitude: 2.3488},
+	})
+
+	tests := []struct {
+		name    string
+		db      []byte
+		addr    string
+		country string
+		city    string
+		network string
+	}{
+		// The first row (mid == 0).
+		{name: "db1 first row", db: db1, addr: "0.0.0.1", country: "US", network: "0.0.0.0/5"},
+		{name: "db1 unknown row", db: db1, addr: "10.1.2.3"},
+		// The last row, which ends at the trailing row.
+		{name: "db1 last row", db: db1, addr: "200.1.2.3", country: "DE", network: "128.0.0.0/1"},
+		{name: "db1 last address", db: db1, addr: "255.255.255.255", country: "DE", network: "128.0.0.0/1"},
+		{name: "db1 ipv6", db: db1, addr: "2001:db8::1"},
+		// Before the first row (mid == 0, with no row before it).
+		{name: "db5 before first row", db: db5, addr: "0.1.2.3"},
+		{name: "db5 middle row", db: db5, addr: "8.8.8.8", country: "US", city: "Mountain View", network: "8.8.8.0/24"},
+		{name: "db5 last row", db: db5, addr: "9.1.2.3", country: "FR", city: "Paris", network: "9.0.0.0/8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := FromBytes(tt.db, VendorIP2Location)
+			if err != nil {
+				t.Fatalf("unable to open database: %s", err)
+			}
+
+			result, err := reader.Lookup(net.ParseIP(tt.addr))
+			if tt.country == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("lookup of %s = %v, %v, want ErrNotFound", tt.addr, result, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("lookup of %s: %s", tt.addr, err)
+			}
+
+			if result.CountryCode != tt.country || result.City != tt.city {
+				t.Errorf("lookup of %s = %q/%q, want %q/%q", tt.addr, result.CountryCode, result.City, tt.country, tt.city)
+			}
+
+			if result.Network == nil {
+				t.Fatalf("network of %s = nil, want %s", tt.addr, tt.network)
+			}
+
+			if *result.Network != tt.network {
+				t.Errorf("network of %s = %s, want %s", tt.addr, *result.Network, tt.network)
+			}
+		})
+	}
+}
+
+func TestBINLocation(t *testing.T) {
+	db := buildBIN(t, 5, []binRow{
+		{from: "0.0.0.0", country: "US", name: "United States of America", region: "California", city: "Mountain View", latitude: 37.5, longitude: -122.25},
+	})
+
+	reader, err := FromBytes(db, VendorIP2Location)
+	if err != nil {
+		t.Fatalf("unable to open database: %s", err)
+	}
+
+	result, err := reader.Lookup(net.ParseIP("8.8.8.8"))
+	if err != nil {
+		t.Fatalf("lookup: %s", err)
+	}
+
+	if result.Subdivision != "California" || result.Lat != 37.5 || result.Long != -122.25 {
+		t.Errorf("lookup = %q (%v, %v), want California (37.5, -122.25)", result.Subdivision, result.Lat, result.Long)
+	}
+
+	if result.EU == nil || *result.EU {
+		t.Errorf("is_in_european_union = %v, want false", result.EU)
+	}
+}
+
+func TestBINCorrupt(t *testing.T) {
+	rows := []binRow{
+		{from: "0.0.0.0", country: "US", name: "United States of America"},
+		{from: "20.0.0.0", country: "DE", name: "Germany"},
+	}
+	db := buildBIN(t, 1, rows)
+	rowsEnd := 64 + (len(rows)+1)*2*4
+
+	// Missing the trailing row.
+	if _, err := FromBytes(db[:rowsEnd-4], VendorIP2Location); !errors.Is(err, errBINCorrupt) {
+		t.Errorf("open of truncated rows = %v, want %v", err, errBINCorrupt)
+	}
+
+	// The rows are intact, but the strings they point to are not.
+	reader, err := FromBytes(db[:rowsEnd+2], VendorIP2Location)
+	if err != nil {
+		t.Fatalf("unable to open database: %s", err)
+	}
+
+	if _, err = reader.Lookup(net.ParseIP("30.0.0.1")); !errors.Is(err, errBINCorrupt) {
+		t.Errorf("lookup with truncated strings = %v, want %v", err, errBINCorrupt)
+	}
+
+	if _, err = FromBytes(db[:63], VendorIP2Location); err == nil {
+		t.Error("open of truncated header succeeded")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package geoip
+
+import (
+	"fmt"
+	"net"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbReader is the adapter for MaxMind DB (mmdb) formatted databases.
+type mmdbReader struct {
+	*maxminddb.Reader
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	reader, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = reader.Verify(); err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("error while attempting to verify geoip data: %w", err)
+	}
+
+	return &mmdbReader{Reader: reader}, nil
+}
+
+func (r *mmdbReader) lookup(addr net.IP, record *Record) (*net.IPNet, bool, error) {
+	return r.LookupNetwork(addr, record)
+}
+
+func (r *mmdbReader) networksWithin(network *net.IPNet, fn func(subnet *net.IPNet, record *Record) bool) error {
+	networks := r.NetworksWithin(network, maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var record Record
+
+		subnet, err := networks.Network(&record)
+		if err != nil {
+			return err
+		}
+
+		if !fn(subnet, &record) {
+			break
+		}
+	}
+
+	return networks.Err()
+}
+
+func (r *mmdbReader) metadata() *maxminddb.Metadata {
+	return &r.Metadata
+}
+
+func (r *mmdbReader) close() error {
+	return r.Close()
+}
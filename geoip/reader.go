@@ -0,0 +1,156 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+// Package geoip looks up the geolocation of IP addresses in Maxmind (or
+// DB-IP/IP2Location) databases, normalizing records into a common Result.
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// Supported database vendors (formats).
+const (
+	VendorMaxMind     = "maxmind"
+	VendorDBIP        = "dbip"
+	VendorIP2Location = "ip2location"
+)
+
+var (
+	// ErrUnsupported is returned when an operation isn't supported by the
+	// format of the database.
+	ErrUnsupported = errors.New("not supported by the loaded database")
+
+	// ErrNotFound is returned by Lookup when the address has no record.
+	ErrNotFound = errors.New("no results found")
+)
+
+// geoReader is a loaded database of a specific vendor, which normalizes its
+// records into Record (the Maxmind GeoIP2 schema), so results are the same
+// regardless of vendor.
+type geoReader interface {
+	// lookup decodes the record of addr into record, returning the network
+	// of the record. found is false if addr has no record.
+	lookup(addr net.IP, record *Record) (network *net.IPNet, found bool, err error)
+
+	// networksWithin invokes fn for each network within network which has a
+	// record, until fn returns false.
+	networksWithin(network *net.IPNet, fn func(subnet *net.IPNet, record *Record) bool) error
+
+	// metadata returns the metadata of the database. Vendors without
+	// Maxmind-style metadata return the equivalent fields.
+	metadata() *maxminddb.Metadata
+
+	close() error
+}
+
+// Reader is an opened geoip database. It is safe for concurrent use.
+type Reader struct {
+	reader geoReader
+}
+
+// Open reads the database at path fully into memory, using the format of
+// vendor (defaults to VendorMaxMind if empty).
+func Open(path, vendor string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromBytes(buf, vendor)
+}
+
+// FromBytes opens the database in buf, using the format of vendor (defaults
+// to VendorMaxMind if empty). buf must not be modified while the Reader is in
+// use.
+func FromBytes(buf []byte, vendor string) (*Reader, error) {
+	var reader geoReader
+	var err error
+
+	switch vendor {
+	case VendorIP2Location:
+		reader, err = newBINReader(buf)
+	case "", VendorMaxMind, VendorDBIP:
+		// DB-IP's mmdb databases use the same schema as GeoIP2 (though with
+		// fewer fields, e.g. no subdivision codes or time zones), so they
+		// share the same adapter.
+		reader, err = newMMDBReader(buf)
+	default:
+		return nil, fmt.Errorf("unknown database vendor: %q", vendor)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{reader: reader}, nil
+}
+
+// Lookup returns the result of addr, with names in DefaultLanguage.
+// ErrNotFound is returned if addr has no record.
+func (r *Reader) Lookup(addr net.IP) (*Result, error) {
+	return r.LookupLang(addr, DefaultLanguage)
+}
+
+// LookupLang is like Lookup, however names are in the requested language (if
+// available), or the first of the fallback languages (see NewResult). See
+// Metadata().Languages for the available languages.
+func (r *Reader) LookupLang(addr net.IP, lang string, fallback ...string) (*Result, error) {
+	var record Record
+
+	network, found, err := r.LookupRecord(addr, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	result := NewResult(addr, &record, lang, fallback...)
+	if !found || !result.Found() {
+		return nil, ErrNotFound
+	}
+
+	prefix := network.String()
+	result.Network = &prefix
+	return result, nil
+}
+
+// LookupRecord decodes the record of addr into record, and returns the
+// network of the record which addr matched. found will be false if addr has
+// no record.
+func (r *Reader) LookupRecord(addr net.IP, record *Record) (network *net.IPNet, found bool, err error) {
+	return r.reader.lookup(addr, record)
+}
+
+// Decode decodes the record of addr into result, using result's maxminddb
+// struct tags. This allows using other Maxmind databases (e.g. ASN), and is
+// only supported by mmdb formatted databases.
+func (r *Reader) Decode(addr net.IP, result interface{}) error {
+	reader, ok := r.reader.(*mmdbReader)
+	if !ok {
+		return ErrUnsupported
+	}
+
+	return reader.Lookup(addr, result)
+}
+
+// NetworksWithin invokes fn for each network within network which has a
+// record, until fn returns false. ErrUnsupported is returned if the format of
+// the database doesn't support iterating over networks.
+func (r *Reader) NetworksWithin(network *net.IPNet, fn func(subnet *net.IPNet, record *Record) bool) error {
+	return r.reader.networksWithin(network, fn)
+}
+
+// Metadata returns the metadata of the database.
+func (r *Reader) Metadata() *maxminddb.Metadata {
+	return r.reader.metadata()
+}
+
+// Close closes the database. The Reader must not be used afterwards.
+func (r *Reader) Close() error {
+	return r.reader.close()
+}
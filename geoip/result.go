@@ -0,0 +1,317 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package geoip
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLanguage is the language used when a name isn't available in the
+// requested language.
+const DefaultLanguage = "en"
+
+// Record is the struct->tag search query to search through the Maxmind DB.
+// Records of other vendors are normalized into the same structure. The
+// confidence fields are only provided by the Enterprise databases, and are
+// nil otherwise.
+type Record struct {
+	City struct {
+		GeoNameID  uint              `maxminddb:"geoname_id"`
+		Names      map[string]string `maxminddb:"names"`
+		Confidence *uint8            `maxminddb:"confidence"`
+	} `maxminddb:"city"`
+	Country struct {
+		GeoNameID         uint              `maxminddb:"geoname_id"`
+		Code              string            `maxminddb:"iso_code"`
+		Names             map[string]string `maxminddb:"names"`
+		IsInEuropeanUnion bool              `maxminddb:"is_in_european_union"`
+		Confidence        *uint8            `maxminddb:"confidence"`
+	} `maxminddb:"country"`
+	Continent struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		Code      string            `maxminddb:"code"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"continent"`
+	Location struct {
+		Lat            float64 `maxminddb:"latitude"`
+		Long           float64 `maxminddb:"longitude"`
+		AccuracyRadius uint16  `maxminddb:"accuracy_radius"`
+		MetroCode      int     `maxminddb:"metro_code"`
+		TimeZone       string  `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code       string `maxminddb:"code"`
+		Confidence *uint8 `maxminddb:"confidence"`
+	} `maxminddb:"postal"`
+	Subdivisions []struct {
+		GeoNameID  uint              `maxminddb:"geoname_id"`
+		Code       string            `maxminddb:"iso_code"`
+		Names      map[string]string `maxminddb:"names"`
+		Confidence *uint8            `maxminddb:"confidence"`
+	} `maxminddb:"subdivisions"`
+	Traits struct {
+		Proxy bool `maxminddb:"is_anonymous_proxy"`
+	} `maxminddb:"traits"`
+
+	// offset is the offset from UTC (in seconds), for vendors which provide
+	// it rather than a time zone.
+	offset *int `maxminddb:"-"`
+}
+
+// Subdivision is a single level of the subdivision hierarchy (e.g. a state,
+// followed by a county) of an address.
+type Subdivision struct {
+	Code       string `json:"iso_code" xml:"iso_code"`
+	Name       string `json:"name" xml:"name"`
+	GeoNameID  uint   `json:"geoname_id,omitempty" xml:"geoname_id,omitempty"`
+	Confidence *uint8 `json:"confidence,omitempty" xml:"confidence,omitempty"`
+}
+
+// SubdivisionList is the subdivision hierarchy of an address, which is
+// encoded as a single <subdivisions> xml element containing a <subdivision>
+// element for each level.
+type SubdivisionList []Subdivision
+
+func (l SubdivisionList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(struct {
+		Items []Subdivision `xml:"subdivision"`
+	}{l}, start)
+}
+
+// LanguageList is a list of language codes, which is encoded as a single
+// <country_languages> xml element containing a <language> element for each
+// language.
+type LanguageList []string
+
+func (l LanguageList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(struct {
+		Items []string `xml:"language"`
+	}{l}, start)
+}
+
+// Result is the normalized geolocation information of an IP address.
+type Result struct {
+	IP            net.IP          `json:"ip" xml:"ip"`
+	Summary       string          `json:"summary" xml:"summary"`
+	City          string          `json:"city" xml:"city"`
+	Subdivision   string          `json:"subdivision" xml:"subdivision"`
+	Region        string          `json:"region,omitempty" xml:"region,omitempty"`
+	RegionCode    string          `json:"region_abbr,omitempty" xml:"region_abbr,omitempty"`
+	Country       string          `json:"country" xml:"country"`
+	CountryCode   string          `json:"country_abbr" xml:"country_abbr"`
+	CountryFlag   string          `json:"country_flag,omitempty" xml:"country_flag,omitempty"`
+	CountryNum    string          `json:"country_iso_numeric,omitempty" xml:"country_iso_numeric,omitempty"`
+	Currency      string          `json:"country_currency,omitempty" xml:"country_currency,omitempty"`
+	Languages     LanguageList    `json:"country_languages,omitempty" xml:"country_languages,omitempty"`
+	EU            *bool           `json:"is_in_european_union,omitempty" xml:"is_in_european_union,omitempty"`
+	Continent     string          `json:"continent" xml:"continent"`
+	ContinentCode string          `json:"continent_abbr" xml:"continent_abbr"`
+	Lat           float64         `json:"latitude" xml:"location>latitude"`
+	Long          float64         `json:"longitude" xml:"location>longitude"`
+	Accuracy      uint16          `json:"accuracy_radius,omitempty" xml:"location>accuracy_radius,omitempty"`
+	MetroCode     int             `json:"metro_code,omitempty" xml:"location>metro_code,omitempty"`
+	Timezone      string          `json:"timezone" xml:"location>timezone"`
+	UTCOffset     *UTCOffset      `json:"utc_offset,omitempty" xml:"location>utc_offset,omitempty"`
+	PostalCode    string          `json:"postal_code,omitempty" xml:"postal_code,omitempty"`
+	Proxy         bool            `json:"proxy" xml:"proxy"`
+	Subdivisions  SubdivisionList `json:"subdivisions,omitempty" xml:"subdivisions,omitempty"`
+
+	// Confidence scores (0-100) of the country, city and postal code, only
+	// available with the Enterprise databases.
+	CountryConfidence *uint8 `json:"country_confidence,omitempty" xml:"country_confidence,omitempty"`
+	CityConfidence    *uint8 `json:"city_confidence,omitempty" xml:"city_confidence,omitempty"`
+	PostalConfidence  *uint8 `json:"postal_confidence,omitempty" xml:"postal_confidence,omitempty"`
+
+	// GeoNames (geonames.org) ids of the city, country and continent, if
+	// provided by the database.
+	CityGeoNameID      uint `json:"city_geoname_id,omitempty" xml:"city_geoname_id,omitempty"`
+	CountryGeoNameID   uint `json:"country_geoname_id,omitempty" xml:"country_geoname_id,omitempty"`
+	ContinentGeoNameID uint `json:"continent_geoname_id,omitempty" xml:"continent_geoname_id,omitempty"`
+
+	// Network is the network of the matched record, which is shared by all
+	// addresses with the same result. nil if the address has no record.
+	Network *string `json:"network" xml:"network,omitempty"`
+}
+
+// Found returns true if the result contains any location information.
+func (r *Result) Found() bool {
+	return r.Summary != ""
+}
+
+var locations sync.Map // IANA zone name -> *time.Location.
+
+// UTCOffset is the offset from UTC of the time zone of a result, encoded in
+// seconds. The offset of IANA time zones is computed when encoded, rather
+// than when the result is created, so results which are cached stay correct
+// across daylight saving time changes.
+type UTCOffset struct {
+	loc   *time.Location // nil for fixed offsets.
+	fixed int
+}
+
+// ZoneOffset returns the offset of the provided IANA time zone. nil is
+// returned if the zone is empty or unknown.
+func ZoneOffset(zone string) *UTCOffset {
+	if zone == "" {
+		return nil
+	}
+
+	loc, found := locations.Load(zone)
+	if !found {
+		l, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil
+		}
+
+		loc, _ = locations.LoadOrStore(zone, l)
+	}
+
+	return &UTCOffset{loc: loc.(*time.Location)}
+}
+
+// Seconds returns the current offset from UTC, in seconds.
+func (o UTCOffset) Seconds() int {
+	if o.loc == nil {
+		return o.fixed
+	}
+
+	_, offset := time.Now().In(o.loc).Zone()
+	return offset
+}
+
+func (o UTCOffset) String() string {
+	return strconv.Itoa(o.Seconds())
+}
+
+func (o UTCOffset) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+// MarshalJSON encodes the offset as a number, rather than a string.
+func (o UTCOffset) MarshalJSON() ([]byte, error) {
+	return o.MarshalText()
+}
+
+// UnmarshalJSON decodes a previously encoded offset, which is then fixed.
+// See ZoneOffset to keep the offset of a time zone current.
+func (o *UTCOffset) UnmarshalJSON(b []byte) error {
+	o.loc = nil
+	return json.Unmarshal(b, &o.fixed)
+}
+
+// localizedName returns the name in the first of langs it's available in.
+func localizedName(names map[string]string, langs []string) string {
+	for i := 0; i < len(langs); i++ {
+		if name := names[langs[i]]; name != "" {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// NewResult builds the normalized result for addr from its database record,
+// with names in the requested language (if available). Otherwise, names are
+// in the first of the fallback languages they're available in, which
+// defaults to DefaultLanguage.
+func NewResult(addr net.IP, record *Record, lang string, fallback ...string) *Result {
+	if len(fallback) == 0 {
+		fallback = []string{DefaultLanguage}
+	}
+	langs := append([]string{lang}, fallback...)
+
+	result := &Result{
+		IP:            addr,
+		City:          localizedName(record.City.Names, langs),
+		Country:       localizedName(record.Country.Names, langs),
+		CountryCode:   record.Country.Code,
+		Continent:     localizedName(record.Continent.Names, langs),
+		ContinentCode: record.Continent.Code,
+		Lat:           record.Location.Lat,
+		Long:          record.Location.Long,
+		Accuracy:      record.Location.AccuracyRadius,
+		MetroCode:     record.Location.MetroCode,
+		Timezone:      record.Location.TimeZone,
+		PostalCode:    record.Postal.Code,
+		Proxy:         record.Traits.Proxy,
+
+		CountryConfidence: record.Country.Confidence,
+		CityConfidence:    record.City.Confidence,
+		PostalConfidence:  record.Postal.Confidence,
+
+		CityGeoNameID:      record.City.GeoNameID,
+		CountryGeoNameID:   record.Country.GeoNameID,
+		ContinentGeoNameID: record.Continent.GeoNameID,
+	}
+
+	if result.UTCOffset = ZoneOffset(result.Timezone); result.UTCOffset == nil && record.offset != nil {
+		result.UTCOffset = &UTCOffset{fixed: *record.offset}
+	}
+
+	// The flag, numeric code, currency, languages and EU membership are
+	// unknown if the country is unknown.
+	if result.CountryCode != "" {
+		result.CountryFlag = countryFlag(result.CountryCode)
+		result.CountryNum = countryNumeric(result.CountryCode)
+
+		if info := countryInfo(result.CountryCode); info != nil {
+			result.Currency = info.currency
+			result.Languages = info.languages
+		}
+
+		eu := record.Country.IsInEuropeanUnion
+		result.EU = &eu
+	}
+
+	var subdiv []string
+	for i := 0; i < len(record.Subdivisions); i++ {
+		name := localizedName(record.Subdivisions[i].Names, langs)
+		subdiv = append(subdiv, name)
+
+		result.Subdivisions = append(result.Subdivisions, Subdivision{
+			Code:       record.Subdivisions[i].Code,
+			Name:       name,
+			GeoNameID:  record.Subdivisions[i].GeoNameID,
+			Confidence: record.Subdivisions[i].Confidence,
+		})
+	}
+	result.Subdivision = strings.Join(subdiv, ", ")
+
+	if len(result.Subdivisions) > 0 {
+		result.Region = result.Subdivisions[0].Name
+		result.RegionCode = result.Subdivisions[0].Code
+	}
+
+	var summary []string
+	if result.City != "" {
+		summary = append(summary, result.City)
+	}
+
+	if result.Subdivision != "" && result.City != result.Subdivision {
+		summary = append(summary, result.Subdivision)
+	}
+
+	if result.Country != "" && len(summary) == 0 {
+		summary = append(summary, result.Country)
+	} else if result.CountryCode != "" {
+		summary = append(summary, result.CountryCode)
+	}
+
+	if result.Continent != "" && len(summary) == 0 {
+		summary = append(summary, result.Continent)
+	} else if result.ContinentCode != "" && result.Subdivision == "" && result.City == "" {
+		summary = append(summary, result.ContinentCode)
+	}
+
+	result.Summary = strings.Join(summary, ", ")
+
+	return result
+}
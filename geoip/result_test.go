@@ -0,0 +1,228 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package geoip
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures in testdata contain the same records, which in the Enterprise
+// fixture also have confidence values:
+//
+//	1.0.0.0/24  US, with a city, subdivision, postal code, metro code and
+//	            accuracy radius.
+//	2.0.0.0/24  DE (in the EU), with an accuracy radius, but no postal or
+//	            metro code.
+//	3.0.0.0/24  only a continent (no country).
+const (
+	fixtureGeoLite2   = "testdata/GeoLite2-City-Test.mmdb"
+	fixtureEnterprise = "testdata/GeoIP2-Enterprise-Test.mmdb"
+)
+
+// lookupFixture returns the result of addr in the fixture at path.
+func lookupFixture(t *testing.T, path, addr string) *Result {
+	t.Helper()
+
+	reader, err := Open(path, VendorMaxMind)
+	if err != nil {
+		t.Fatalf("unable to open %s: %s", path, err)
+	}
+	defer reader.Close()
+
+	result, err := reader.Lookup(net.ParseIP(addr))
+	if err != nil {
+		t.Fatalf("lookup of %s in %s: %s", addr, path, err)
+	}
+
+	return result
+}
+
+func TestResultConfidence(t *testing.T) {
+	result := lookupFixture(t, fixtureEnterprise, "1.0.0.1")
+
+	for name, tt := range map[string]struct {
+		got  *uint8
+		want uint8
+	}{
+		"country":     {result.CountryConfidence, 99},
+		"city":        {result.CityConfidence, 50},
+		"postal":      {result.PostalConfidence, 20},
+		"subdivision": {result.Subdivisions[0].Confidence, 80},
+	} {
+		if tt.got == nil || *tt.got != tt.want {
+			t.Errorf("%s confidence = %v, want %d", name, tt.got, tt.want)
+		}
+	}
+
+	// GeoLite2 databases have no confidence values, so they're omitted
+	// rather than returned as 0.
+	result = lookupFixture(t, fixtureGeoLite2, "1.0.0.1")
+
+	for name, got := range map[string]*uint8{
+		"country":     result.CountryConfidence,
+		"city":        result.CityConfidence,
+		"postal":      result.PostalConfidence,
+		"subdivision": result.Subdivisions[0].Confidence,
+	} {
+		if got != nil {
+			t.Errorf("%s confidence = %d, want nil", name, *got)
+		}
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "confidence") {
+		t.Errorf("GeoLite2 result contains confidence fields: %s", b)
+	}
+}
+
+func TestResultEU(t *testing.T) {
+	tests := []struct {
+		addr string
+		want *bool
+	}{
+		{"1.0.0.1", new(bool)},     // Outside of the EU.
+		{"2.0.0.1", newBool(true)}, // In the EU.
+		{"3.0.0.1", nil},           // Unknown country.
+	}
+
+	for _, tt := range tests {
+		got := lookupFixture(t, fixtureGeoLite2, tt.addr).EU
+
+		switch {
+		case tt.want == nil && got != nil:
+			t.Errorf("%s: EU = %t, want nil", tt.addr, *got)
+		case tt.want != nil && (got == nil || *got != *tt.want):
+			t.Errorf("%s: EU = %v, want %t", tt.addr, got, *tt.want)
+		}
+	}
+
+	// Unknown EU membership is omitted, rather than reported as false.
+	b, err := json.Marshal(lookupFixture(t, fixtureGeoLite2, "3.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "is_in_european_union") {
+		t.Errorf("result of unknown country contains is_in_european_union: %s", b)
+	}
+}
+
+func newBool(v bool) *bool {
+	return &v
+}
+
+// marshalFields returns the json fields of result.
+func marshalFields(t *testing.T, result *Result) map[string]interface{} {
+	t.Helper()
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	if err = json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	return fields
+}
+
+func TestResultLocation(t *testing.T) {
+	tests := []struct {
+		addr      string
+		accuracy  uint16
+		metroCode int
+	}{
+		{"1.0.0.1", 1000, 807},
+		{"2.0.0.1", 100, 0}, // No metro code.
+		{"3.0.0.1", 0, 0},   // No location.
+	}
+
+	for _, tt := range tests {
+		result := lookupFixture(t, fixtureGeoLite2, tt.addr)
+
+		if result.Accuracy != tt.accuracy {
+			t.Errorf("%s: accuracy = %d, want %d", tt.addr, result.Accuracy, tt.accuracy)
+		}
+
+		if result.MetroCode != tt.metroCode {
+			t.Errorf("%s: metro code = %d, want %d", tt.addr, result.MetroCode, tt.metroCode)
+		}
+
+		// Fields missing from the record are omitted, rather than 0.
+		fields := marshalFields(t, result)
+		if _, ok := fields["accuracy_radius"]; ok != (tt.accuracy != 0) {
+			t.Errorf("%s: accuracy_radius present = %t, want %t", tt.addr, ok, tt.accuracy != 0)
+		}
+
+		if _, ok := fields["metro_code"]; ok != (tt.metroCode != 0) {
+			t.Errorf("%s: metro_code present = %t, want %t", tt.addr, ok, tt.metroCode != 0)
+		}
+	}
+}
+
+func TestResultPostalCode(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"1.0.0.1", "94035"},
+		{"2.0.0.1", ""}, // No postal data.
+	}
+
+	for _, tt := range tests {
+		result := lookupFixture(t, fixtureGeoLite2, tt.addr)
+		if result.PostalCode != tt.want {
+			t.Errorf("%s: postal code = %q, want %q", tt.addr, result.PostalCode, tt.want)
+		}
+
+		value, ok := marshalFields(t, result)["postal_code"]
+		if tt.want == "" && ok {
+			t.Errorf("%s: postal_code = %v, want omitted", tt.addr, value)
+		} else if tt.want != "" && value != tt.want {
+			t.Errorf("%s: postal_code = %v, want %q", tt.addr, value, tt.want)
+		}
+	}
+}
+
+func TestUTCOffset(t *testing.T) {
+	if offset := ZoneOffset("Not/AZone"); offset != nil {
+		t.Errorf("offset of unknown zone = %s, want nil", offset)
+	}
+
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %s", err)
+	}
+	_, want := time.Now().In(loc).Zone()
+
+	b, err := json.Marshal(ZoneOffset("America/Los_Angeles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != strconv.Itoa(want) {
+		t.Errorf("offset = %s, want %d", b, want)
+	}
+
+	// The timezone is always present, even when empty.
+	fields := marshalFields(t, lookupFixture(t, fixtureGeoLite2, "3.0.0.1"))
+	if _, ok := fields["timezone"]; !ok {
+		t.Error("timezone omitted from result without a time zone")
+	}
+
+	if _, ok := fields["utc_offset"]; ok {
+		t.Error("utc_offset present in result without a time zone")
+	}
+}
@@ -5,21 +5,35 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"os"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 	"github.com/go-web/httprl"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	"github.com/lrstanley/geoip/geoip"
 	"github.com/lrstanley/recoverer"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 //go:generate touch public/dist/.gitkeep
@@ -30,7 +44,13 @@ var apiPong = map[string]bool{
 	"pong": true,
 }
 
-var mapLimiter = NewMapLimiter(10)
+// VersionResult is the build information of the running binary.
+type VersionResult struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
 
 func initHTTP(closer chan struct{}) {
 	dist, err := fs.Sub(publicDist, "public/dist")
@@ -39,33 +59,66 @@ func initHTTP(closer chan struct{}) {
 	}
 
 	r := chi.NewRouter()
-	if flags.HTTP.Proxy {
-		r.Use(middleware.RealIP)
+	r.Use(requestID)
+	if len(trustedProxies) > 0 {
+		r.Use(withPeer, trustedRealIP)
+	} else if flags.HTTP.Proxy {
+		r.Use(withPeer, middleware.RealIP)
+	}
+
+	if tracingEnabled {
+		r.Use(tracingMiddleware)
 	}
 
 	r.Use(recoverer.New(recoverer.Options{Logger: os.Stderr, Show: flags.Debug, Simple: false}))
-	r.Use(middleware.Logger)
+	r.Use(accessLogger())
+	if flags.HTTP.Metrics {
+		r.Use(metricsMiddleware)
+	}
+	if flags.HTTP.RequestTimeout > 0 {
+		r.Use(timeoutMiddleware(flags.HTTP.RequestTimeout))
+	}
 	r.Use(middleware.StripSlashes)
-	r.Use(middleware.Compress(9))
-	r.Use(dbDetailsMiddleware)
 
-	if flags.HTTP.Throttle > 0 {
-		r.Use(middleware.ThrottleBacklog(flags.HTTP.Throttle, flags.HTTP.Throttle*2, 30*time.Second))
+	compress, err := compressor(flags.HTTP.CompressLevel, flags.HTTP.CompressAlgos)
+	if err != nil {
+		fmt.Printf("error configuring compression: %s\n", err)
+		os.Exit(1)
 	}
+	r.Use(compress)
+	r.Use(dbDetailsMiddleware)
 
 	if flags.Debug {
 		r.Mount("/debug", middleware.Profiler())
+		r.With(middleware.NoCache).Get("/api/debug/record/{ip}", apiDebugRecord)
 	}
 
-	r.Mount("/dist", http.StripPrefix("/dist/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Vary", "Accept-Encoding")
-		w.Header().Set("Cache-Control", "public, max-age=7776000")
-		http.FileServer(http.FS(dist)).ServeHTTP(w, r)
-	})))
+	// Metrics are registered outside of the api group, so they aren't
+	// subject to cors or rate limiting.
+	if flags.HTTP.Metrics {
+		r.With(middleware.NoCache).Handle("/metrics", promhttp.Handler())
+	}
+
+	// Admin endpoints are only available when a token is configured, and
+	// aren't subject to cors or rate limiting.
+	if flags.HTTP.AdminToken != "" {
+		r.With(middleware.NoCache, adminAuth).Post("/api/admin/reload", adminReload)
+	}
+
+	// The frontend is still embedded when running api-only, it just isn't
+	// routed.
+	if !flags.HTTP.APIOnly {
+		assets, err := loadAssets(dist)
+		if err != nil {
+			panic(err)
+		}
+
+		r.Mount("/dist", http.StripPrefix("/dist/", assetHandler(dist, assets)))
+	}
 
 	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasPrefix(r.URL.Path, "/api") {
-			http.NotFound(w, r)
+		if flags.HTTP.APIOnly || strings.HasPrefix(r.URL.Path, "/api") {
+			errorResponse(w, r, http.StatusNotFound, errCodeUnknownEndpoint, "unknown endpoint")
 			return
 		}
 
@@ -76,76 +129,231 @@ func initHTTP(closer chan struct{}) {
 		w.Write(b)
 	})
 
+	// Other methods would otherwise receive chi's plain text responses.
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		errorResponse(w, r, http.StatusNotFound, errCodeUnknownEndpoint, "unknown endpoint")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		errorResponse(w, r, http.StatusMethodNotAllowed, errCodeInvalidRequest, "method %s not allowed", r.Method)
+	})
+
 	if flags.HTTP.CORS == nil || len(flags.HTTP.CORS) == 0 {
 		flags.HTTP.CORS = []string{"*"}
 	}
+	allowedHeaders := append(append([]string(nil), flags.HTTP.CORSHeaders...), apiKeyHeader, "X-Request-ID")
+	if basicCredentials != nil {
+		allowedHeaders = append(allowedHeaders, "Authorization")
+	}
+
 	corsh := cors.New(cors.Options{
-		AllowedOrigins: flags.HTTP.CORS,
-		AllowedMethods: []string{"GET", "HEAD", "OPTIONS"},
-		AllowedHeaders: []string{"Accept", "Content-Type"},
+		AllowedOrigins:   flags.HTTP.CORS,
+		AllowedMethods:   flags.HTTP.CORSMethods,
+		AllowedHeaders:   allowedHeaders,
+		AllowCredentials: flags.HTTP.CORSCredentials,
 		ExposedHeaders: []string{
-			"X-Maxmind-Type", "X-Maxmind-Version",
-			"X-Ratelimit-Limit", "X-Ratelimit-Remaining", "X-Ratelimit-Reset",
-			"X-Cache",
+			"X-Maxmind-Type", "X-Maxmind-Version", "X-Maxmind-Build", "X-Generated-At", "X-Database-Age",
+			"X-Ratelimit-Limit", "X-Ratelimit-Remaining", "X-Ratelimit-Reset", "Retry-After",
+			"X-Cache", "X-Results-Truncated", "Content-Disposition", "X-Request-ID",
 		},
 		MaxAge: 3600,
 	})
 
-	limiter := &httprl.RateLimiter{
-		Backend:  mapLimiter,
-		Limit:    uint64(flags.HTTP.Limit),
-		Interval: 60 * 60, // 1h.
-		LimitExceededFunc: func(w http.ResponseWriter, r *http.Request) {
-			logger.Printf(
-				"connection %s has hit rate limit (limit: %s, reset: %s)",
-				r.RemoteAddr,
-				w.Header().Get("X-Ratelimit-Limit"),
-				w.Header().Get("X-Ratelimit-Reset"),
-			)
-		},
-		KeyMaker: httprl.DefaultKeyMaker, // This uses IP address by default.
+	if flags.HTTP.RedisURL != "" {
+		rateLimiter, err = NewRedisLimiter(flags.HTTP.RedisURL)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		mapLimiter.Start()
+		defer mapLimiter.Stop()
+		registerLimiterMetrics()
 	}
 
-	mapLimiter.Start()
-	defer mapLimiter.Stop()
+	limiter := limitMiddleware(func(limit int) *httprl.RateLimiter {
+		return &httprl.RateLimiter{
+			Backend:           rateLimiter,
+			Limit:             uint64(limit),
+			Interval:          limitInterval(),
+			LimitExceededFunc: limitExceeded,
+			KeyMaker:          rateKey, // This uses API key or IP address.
+			// If the backend is unavailable (e.g. redis is down), allow
+			// requests rather than rejecting everything.
+			Policy:   httprl.AllowPolicy,
+			ErrorLog: logger,
+		}
+	})
 
-	if flags.HTTP.Limit > 0 {
-		r.With(corsh.Handler, middleware.NoCache, limiter.Handle).Group(registerAPI)
-	} else {
-		r.With(corsh.Handler, middleware.NoCache).Group(registerAPI)
-	}
+	r.With(corsh.Handler, basicAuth, formatExtension, serverTiming, cacheControl(flags.HTTP.LookupMaxAge), maxBodySize(flags.HTTP.MaxBodyBytes), allowlistMiddleware(limiter)).Group(registerAPI)
+
+	// Preflight requests are answered by the cors handler itself, however
+	// they must match a route for it to be invoked.
+	r.With(corsh.Handler).Options("/api/*", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
 
 	// Register the /api/ping route separately, as it shouldn't be counted
 	// towards API limits. This endpoint will both let users verify that the
 	// service is functional, but also let them use headers to check API
 	// limit information. This endpoint is the only one which has HTTP HEAD
 	// support.
-	r.With(corsh.Handler, middleware.NoCache, rateHeaderMiddleware).Get("/api/ping", pingHandler)
-	r.With(corsh.Handler, middleware.NoCache, rateHeaderMiddleware).Head("/api/ping", pingHandler)
+	pingAuth := basicAuth
+	if flags.HTTP.PublicPing {
+		pingAuth = func(next http.Handler) http.Handler { return next }
+	}
+	r.With(corsh.Handler, pingAuth, middleware.NoCache, rateHeaderMiddleware).Get("/api/ping", pingHandler)
+	r.With(corsh.Handler, pingAuth, middleware.NoCache, rateHeaderMiddleware).Head("/api/ping", pingHandler)
+
+	// Build information, for deployment verification, is also not rate limited.
+	r.With(corsh.Handler, basicAuth, middleware.NoCache, rateHeaderMiddleware).Get("/api/version", versionHandler)
+
+	// Database metadata is also not rate limited.
+	r.With(corsh.Handler, basicAuth, middleware.NoCache, rateHeaderMiddleware).Get("/api/meta", apiMeta)
+
+	// Liveness and readiness probes, also not subject to api limits.
+	r.With(middleware.NoCache).Get("/healthz", healthHandler)
+	r.With(middleware.NoCache).Get("/readyz", readyHandler)
 
 	srv := http.Server{
 		Addr:         flags.HTTP.Bind,
 		Handler:      r,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		ReadTimeout:  flags.HTTP.ReadTimeout,
+		WriteTimeout: flags.HTTP.WriteTimeout,
+		IdleTimeout:  flags.HTTP.IdleTimeout,
 	}
 
+	// The server falls back to the read timeout, if no idle timeout is set.
+	idle := srv.IdleTimeout
+	if idle == 0 {
+		idle = srv.ReadTimeout
+	}
+
+	logger.Printf(
+		"http timeouts: read: %s, write: %s, idle: %s, request: %s (0s = none)",
+		srv.ReadTimeout, srv.WriteTimeout, idle, flags.HTTP.RequestTimeout,
+	)
+
+	// Additional servers which should be shutdown alongside the main server.
+	var extra []*http.Server
+	var h3 *http3.Server
+
 	if flags.HTTP.TLS.Use {
 		srv.TLSConfig = &tls.Config{PreferServerCipherSuites: true}
 
+		if len(flags.HTTP.TLS.Hosts) > 0 {
+			acme := &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(flags.HTTP.TLS.Hosts...),
+				Cache:      autocert.DirCache(flags.HTTP.TLS.ACMECache),
+				Email:      flags.HTTP.TLS.ACMEEmail,
+			}
+			srv.TLSConfig = acme.TLSConfig()
+
+			// Answers ACME HTTP-01 challenges. All other requests are
+			// redirected to https (permanently, if a redirect listener sharing
+			// the same bind was requested).
+			var fallback http.Handler
+			if flags.HTTP.TLS.Redirect && flags.HTTP.TLS.RedirectBind == flags.HTTP.TLS.ACMEBind {
+				fallback = http.HandlerFunc(redirectHandler)
+			}
+
+			extra = append(extra, serveExtra("acme challenge", flags.HTTP.TLS.ACMEBind, acme.HTTPHandler(fallback)))
+		}
+
+		if flags.HTTP.TLS.Redirect && (len(flags.HTTP.TLS.Hosts) == 0 || flags.HTTP.TLS.RedirectBind != flags.HTTP.TLS.ACMEBind) {
+			extra = append(extra, serveExtra("https redirect", flags.HTTP.TLS.RedirectBind, http.HandlerFunc(redirectHandler)))
+		}
+
+		// Static certificates are reloaded when rotated on disk.
+		if srv.TLSConfig.GetCertificate == nil {
+			certs, err := newCertReloader(flags.HTTP.TLS.Cert, flags.HTTP.TLS.Key)
+			if err != nil {
+				fmt.Printf("error loading tls certificate: %s\n", err)
+				os.Exit(1)
+			}
+
+			srv.TLSConfig.GetCertificate = certs.GetCertificate
+			go certs.watch(flags.WatchInterval)
+		}
+
+		if flags.HTTP.TLS.ClientCA != "" {
+			var ca []byte
+			ca, err = os.ReadFile(flags.HTTP.TLS.ClientCA)
+			if err != nil {
+				fmt.Printf("error reading tls client ca: %s\n", err)
+				os.Exit(1)
+			}
+
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				fmt.Printf("error reading tls client ca: no certificates found in %q\n", flags.HTTP.TLS.ClientCA)
+				os.Exit(1)
+			}
+
+			srv.TLSConfig.ClientCAs = pool
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		if flags.HTTP.TLS.HTTP3 {
+			h3 = &http3.Server{
+				Addr:      flags.HTTP.Bind,
+				Handler:   r,
+				TLSConfig: http3.ConfigureTLSConfig(srv.TLSConfig),
+			}
+
+			// Advertise http/3 support to clients of the tcp server, so they
+			// can upgrade.
+			srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_ = h3.SetQUICHeaders(w.Header())
+				r.ServeHTTP(w, req)
+			})
+
+			go func() {
+				logger.Println("starting http/3 server")
+				err := h3.ListenAndServe()
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					fmt.Printf("error in http/3 server: %s\n", err)
+					os.Exit(1)
+				}
+			}()
+		}
+
 		go func() {
 			logger.Println("starting https server")
-			err := srv.ListenAndServeTLS(flags.HTTP.TLS.Cert, flags.HTTP.TLS.Key)
-			if err != nil {
+
+			// Certificates are provided by srv.TLSConfig.GetCertificate.
+			err := srv.ListenAndServeTLS("", "")
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
 				fmt.Printf("error in https server: %s\n", err)
 				os.Exit(1)
 			}
 		}()
+	} else if path := strings.TrimPrefix(flags.HTTP.Bind, "unix:"); path != flags.HTTP.Bind {
+		// Remove any stale socket left behind from an unclean shutdown.
+		if fi, statErr := os.Stat(path); statErr == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+
+		var ln net.Listener
+		ln, err = net.Listen("unix", path)
+		if err != nil {
+			fmt.Printf("error listening on unix socket: %s\n", err)
+			os.Exit(1)
+		}
+		defer os.Remove(path)
+
+		go func() {
+			logger.Printf("starting http server on unix socket %s", path)
+			err := srv.Serve(ln)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fmt.Printf("error in http server: %s\n", err)
+				os.Exit(1)
+			}
+		}()
 	} else {
 		go func() {
 			logger.Println("starting http server")
 			err := srv.ListenAndServe()
-			if err != nil {
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
 				fmt.Printf("error in http server: %s\n", err)
 				os.Exit(1)
 			}
@@ -153,11 +361,172 @@ func initHTTP(closer chan struct{}) {
 	}
 
 	<-closer
+
+	// Fail readiness checks first, giving load balancers time to stop sending
+	// new requests before the listeners are closed.
+	shuttingDown.Store(true)
+	if flags.HTTP.ShutdownDelay > 0 {
+		fmt.Printf("waiting %s for traffic to drain\n", flags.HTTP.ShutdownDelay)
+		time.Sleep(flags.HTTP.ShutdownDelay)
+	}
+
 	fmt.Println("gracefully closing http connections")
 
-	if err := srv.Close(); err != nil {
-		logger.Printf("error while stopping http server: %s", err)
+	// Allow in-flight requests to complete, up until the timeout, after which
+	// any remaining connections are forcefully closed.
+	ctx, cancel := context.WithTimeout(context.Background(), flags.HTTP.ShutdownTimeout)
+	defer cancel()
+
+	for _, s := range append([]*http.Server{&srv}, extra...) {
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Printf("error while gracefully stopping http server %s (forcing close): %s", s.Addr, err)
+
+			if err = s.Close(); err != nil {
+				logger.Printf("error while stopping http server %s: %s", s.Addr, err)
+			}
+		}
+	}
+
+	if h3 != nil {
+		if err := h3.Shutdown(ctx); err != nil {
+			logger.Printf("error while gracefully stopping http/3 server (forcing close): %s", err)
+
+			if err = h3.Close(); err != nil {
+				logger.Printf("error while stopping http/3 server: %s", err)
+			}
+		}
+	}
+}
+
+// compressAlgos are the algorithms supported by compressor.
+var compressAlgos = []string{"zstd", "br", "gzip", "deflate"}
+
+// compressor returns a response compressor supporting the algorithms of
+// algos, preferring zstd, then brotli, gzip and deflate. level is the
+// gzip/deflate level (1-9), which is also used as the brotli quality and
+// mapped to the closest zstd level. An error is returned if the encoders
+// can't be configured.
+func compressor(level int, algos []string) (func(next http.Handler) http.Handler, error) {
+	// Responses are small, so a single goroutine (and less memory) per zstd
+	// encoder is enough.
+	zstdOpts := []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithLowerEncoderMem(true),
+	}
+
+	// The options are validated once, as encoders are pooled by the
+	// compressor, which can't handle them failing to be created.
+	if _, err := zstd.NewWriter(nil, zstdOpts...); err != nil {
+		return nil, fmt.Errorf("invalid zstd options: %w", err)
+	}
+
+	c := middleware.NewCompressor(level)
+	c.SetEncoder("br", func(w io.Writer, level int) io.Writer {
+		return brotli.NewWriterLevel(w, level)
+	})
+	c.SetEncoder("zstd", func(w io.Writer, _ int) io.Writer {
+		enc, _ := zstd.NewWriter(w, zstdOpts...)
+		return enc
+	})
+
+	allowed := make(map[string]bool, len(algos))
+	for _, algo := range algos {
+		allowed[strings.ToLower(algo)] = true
+	}
+
+	if len(allowed) == len(compressAlgos) {
+		return c.Handler, nil
+	}
+
+	// The compressor can't be restricted to a subset of its encoders, so
+	// instead, the algorithms which aren't allowed are removed from the
+	// request. This also prevents serving them for pre-compressed assets.
+	return func(next http.Handler) http.Handler {
+		handler := c.Handler(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if header := r.Header.Get("Accept-Encoding"); header != "" {
+				var accepted []string
+				for _, encoding := range strings.Split(header, ",") {
+					name, _, _ := strings.Cut(encoding, ";")
+					if allowed[strings.ToLower(strings.TrimSpace(name))] {
+						accepted = append(accepted, encoding)
+					}
+				}
+
+				if len(accepted) > 0 {
+					r.Header.Set("Accept-Encoding", strings.Join(accepted, ","))
+				} else {
+					r.Header.Del("Accept-Encoding")
+				}
+			}
+
+			handler.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// timeoutMiddleware cancels the request context after timeout. If the
+// handler hasn't written a response by the time it returns, a 503 is returned.
+func timeoutMiddleware(timeout time.Duration) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Websocket connections have their own max lifetime.
+			if websocket.IsWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			if ctx.Err() == context.DeadlineExceeded && ww.Status() == 0 {
+				errorResponse(w, r, http.StatusServiceUnavailable, errCodeTimeout, "request timed out after %s", timeout)
+			}
+		})
+	}
+}
+
+// serveExtra starts an auxiliary plain http server in the background, which
+// should be shutdown alongside the main server.
+func serveExtra(name, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		logger.Printf("starting %s server on %s", name, srv.Addr)
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("error in %s server: %s\n", name, err)
+			os.Exit(1)
+		}
+	}()
+
+	return srv
+}
+
+// redirectHandler permanently redirects the request to its https
+// equivalent, preserving the path and query.
+func redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	// Include the port of the https server, if it's not the default.
+	if _, port, err := net.SplitHostPort(flags.HTTP.Bind); err == nil && port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
 	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
 }
 
 func pingHandler(w http.ResponseWriter, r *http.Request) {
@@ -171,3 +540,75 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_ = enc.Encode(apiPong)
 }
+
+// versionHandler responds with the build information of the running binary.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = enc.Encode(&VersionResult{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: date,
+		GoVersion: runtime.Version(),
+	})
+}
+
+// healthHandler reports that the process is up.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// shuttingDown is set once shutdown has been requested.
+var shuttingDown atomic.Bool
+
+// readyHandler reports if the service is ready to serve lookups, i.e. if the
+// database has been loaded (and with --http.deep-healthcheck, can answer
+// lookups), and the service isn't shutting down.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	if shuttingDown.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("shutting down"))
+		return
+	}
+
+	if !db.loaded() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("database not loaded"))
+		return
+	}
+
+	if flags.HTTP.DeepHealthcheck {
+		if err := canaryLookup(); err != nil {
+			logger.Printf("readiness check failed: %s", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// canaryLookup looks up --http.healthcheck-ip in the database, bypassing the
+// lookup cache, returning an error if the lookup fails or has no results.
+func canaryLookup() error {
+	addr := net.ParseIP(flags.HTTP.HealthcheckIP)
+
+	var record geoip.Record
+	_, found, err := db.LookupNetwork(addr, &record)
+	if err != nil {
+		return fmt.Errorf("lookup of %s failed: %w", addr, err)
+	}
+
+	if !found || !newAddrResult(addr, &record, "").Found() {
+		return fmt.Errorf("lookup of %s returned no results", addr)
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/lrstanley/geoip/geoip"
+	bogon "github.com/lrstanley/go-bogon"
+)
+
+// parseRange parses an inclusive "start-end" address range (e.g.
+// "192.0.2.10-192.0.2.50"), returning the minimal list of networks which
+// cover it. Ranges spanning more than max addresses return an error.
+func parseRange(raw string, max int64) ([]*net.IPNet, error) {
+	parts := strings.SplitN(raw, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid range specified: %s", raw)
+	}
+
+	start, err := netip.ParseAddr(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid range start specified: %s", parts[0])
+	}
+
+	end, err := netip.ParseAddr(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid range end specified: %s", parts[1])
+	}
+
+	start, end = start.Unmap(), end.Unmap()
+
+	if start.Is4() != end.Is4() {
+		return nil, fmt.Errorf("range start and end must be of the same address family")
+	}
+
+	if start.Compare(end) > 0 {
+		return nil, fmt.Errorf("range start must not be after range end")
+	}
+
+	size := new(big.Int).Sub(new(big.Int).SetBytes(end.AsSlice()), new(big.Int).SetBytes(start.AsSlice()))
+	if size.Add(size, big.NewInt(1)).Cmp(big.NewInt(max)) > 0 {
+		return nil, fmt.Errorf("range too large (max: %d addresses)", max)
+	}
+
+	var networks []*net.IPNet
+	for {
+		// Find the widest prefix which starts at start, and doesn't extend
+		// past end.
+		bits := start.BitLen()
+		for bits > 0 {
+			prefix := netip.PrefixFrom(start, bits-1).Masked()
+			if prefix.Addr() != start || geoip.LastAddr(prefix).Compare(end) > 0 {
+				break
+			}
+			bits--
+		}
+
+		prefix := netip.PrefixFrom(start, bits)
+		networks = append(networks, &net.IPNet{
+			IP:   net.IP(start.AsSlice()),
+			Mask: net.CIDRMask(bits, start.BitLen()),
+		})
+
+		last := geoip.LastAddr(prefix)
+		if last.Compare(end) >= 0 {
+			break
+		}
+		start = last.Next()
+	}
+
+	return networks, nil
+}
+
+// parseNetworks parses a list of IPs and/or CIDRs (IPv4 or IPv6).
+func parseNetworks(entries []string) (networks []*net.IPNet, err error) {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip/cidr: %q", entry)
+			}
+
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip/cidr: %q: %w", entry, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// containsIP returns true if ip is within any of the networks.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reservedAddr returns true if ip is within a private, loopback, link-local,
+// multicast or otherwise reserved (bogon) range, which will never have any
+// geoip data.
+func reservedAddr(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+
+	is, _ := bogon.Is(ip.String())
+	return is
+}
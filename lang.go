@@ -0,0 +1,93 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/lrstanley/geoip/geoip"
+	"golang.org/x/text/language"
+)
+
+// defaultLanguage is the language used when the client doesn't request one
+// (and none of --http.lang-fallback are available).
+const defaultLanguage = geoip.DefaultLanguage
+
+// negotiateLanguage returns the database language which best matches the
+// "lang" query parameter, or if not provided, the Accept-Language header,
+// followed by the first available language of --http.lang-fallback. The
+// Content-Language and Vary response headers are also set.
+func negotiateLanguage(w http.ResponseWriter, r *http.Request) string {
+	w.Header().Add("Vary", "Accept-Language")
+
+	lang := matchLanguage(r)
+	w.Header().Set("Content-Language", lang)
+	return lang
+}
+
+func matchLanguage(r *http.Request) string {
+	mcache.RLock()
+	var available []string
+	if mcache.cache != nil {
+		available = mcache.cache.Languages
+	}
+	mcache.RUnlock()
+
+	var desired []language.Tag
+
+	if lang := strings.TrimSpace(r.FormValue("lang")); lang != "" {
+		tag, err := language.Parse(lang)
+		if err != nil {
+			return fallbackLanguage(available)
+		}
+		desired = []language.Tag{tag}
+	} else {
+		desired, _, _ = language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	}
+
+	if len(desired) == 0 {
+		return fallbackLanguage(available)
+	}
+
+	// The first supported language is used as the fallback by the matcher.
+	supported := []language.Tag{language.English}
+	names := []string{defaultLanguage}
+
+	for _, name := range available {
+		if name == defaultLanguage {
+			continue
+		}
+
+		tag, err := language.Parse(name)
+		if err != nil {
+			continue
+		}
+
+		supported = append(supported, tag)
+		names = append(names, name)
+	}
+
+	_, index, confidence := language.NewMatcher(supported).Match(desired...)
+	if confidence == language.No {
+		return fallbackLanguage(available)
+	}
+
+	return names[index]
+}
+
+// fallbackLanguage returns the first language of --http.lang-fallback which
+// is available in the database, or defaultLanguage if none are.
+func fallbackLanguage(available []string) string {
+	for _, lang := range flags.HTTP.LangFallback {
+		for _, name := range available {
+			if strings.EqualFold(lang, name) {
+				return name
+			}
+		}
+	}
+
+	return defaultLanguage
+}
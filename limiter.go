@@ -9,31 +9,156 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/go-web/httprl"
 )
 
+// rateBackend is a httprl.Backend which also allows querying the current hit
+// count of a key, and counting multiple hits at once.
+type rateBackend interface {
+	httprl.Backend
+	Get(key string, ttlsec int32) (count uint64, remttl int32)
+	Add(key string, n uint64, ttlsec int32) (count uint64, remttl int32)
+}
+
+var (
+	mapLimiter = NewMapLimiter(10)
+
+	// rateLimiter is the active rate limiter backend, which defaults to the
+	// in-memory mapLimiter.
+	rateLimiter rateBackend = mapLimiter
+)
+
+// apiKeyHeader is the header used by clients to supply an api key, which may
+// have a higher (or lower) rate limit than anonymous clients.
+const apiKeyHeader = "X-API-Key"
+
+// rateKey is a httprl.KeyMaker which keys requests by their api key (if it's
+// a recognized key), falling back to the client IP address. Unrecognized
+// keys are treated as anonymous.
+func rateKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		if _, ok := flags.HTTP.Keys[key]; ok {
+			// Hashed, so keys aren't stored as-is in the backend.
+			sum := sha256.Sum256([]byte(key))
+			return "key:" + hex.EncodeToString(sum[:8])
+		}
+	}
+
+	return httprl.DefaultKeyMaker(r)
+}
+
+// allowlist contains the networks which are exempt from rate limiting.
+var allowlist []*net.IPNet
+
+// rateExempt returns true if the client is in the allowlist.
+func rateExempt(r *http.Request) bool {
+	if len(allowlist) == 0 {
+		return false
+	}
+
+	return containsIP(allowlist, net.ParseIP(clientIP(r)))
+}
+
+// allowlistMiddleware bypasses the provided rate limiting middleware for
+// clients in the allowlist.
+func allowlistMiddleware(limiter func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		limited := limiter(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rateExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			limited.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitInterval returns the rate limit window, in seconds.
+func limitInterval() int32 {
+	return int32(flags.HTTP.LimitInterval / time.Second)
+}
+
+// rateLimit returns the rate limit (per interval) which applies to the
+// request, based on its api key (if any).
+func rateLimit(r *http.Request) int {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		if limit, ok := flags.HTTP.Keys[key]; ok {
+			return limit
+		}
+	}
+
+	return flags.HTTP.Limit
+}
+
+// limitMiddleware applies rate limiting to requests, using the limit tier that
+// applies to the request (see rateLimit). newLimiter is invoked once for each
+// distinct limit.
+func limitMiddleware(newLimiter func(limit int) *httprl.RateLimiter) func(next http.Handler) http.Handler {
+	limiters := map[int]*httprl.RateLimiter{
+		flags.HTTP.Limit: newLimiter(flags.HTTP.Limit),
+	}
+
+	for _, limit := range flags.HTTP.Keys {
+		if _, ok := limiters[limit]; !ok {
+			limiters[limit] = newLimiter(limit)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		handlers := make(map[int]http.Handler, len(limiters))
+		for limit, limiter := range limiters {
+			handlers[limit] = limiter.Handle(next)
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := rateLimit(r)
+			if limit <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			handlers[limit].ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateHeaderMiddleware adds the X-Ratelimit-* headers to responses of api
+// endpoints which aren't themselves rate limited (e.g. /api/ping), so clients
+// can check their remaining quota. Rate limited endpoints already receive the
+// headers from the limiter (see limitMiddleware).
+//
 // httprl's interface{} implementation currently has no way of obtaining the
 // current rate limit without having the check itself count against the
 // connections total limit. As such, this will have to be done manually.
 func rateHeaderMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if flags.HTTP.Limit <= 0 {
+		limit := rateLimit(r)
+		if limit <= 0 || rateExempt(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		rate, remttl := mapLimiter.Get(httprl.DefaultKeyMaker(r), 60*60)
-		remaining := uint64(flags.HTTP.Limit) - rate
-		if remaining < 0 {
-			remaining = 0
+		rate, remttl := rateLimiter.Get(rateKey(r), limitInterval())
+
+		var remaining uint64
+		if rate < uint64(limit) {
+			remaining = uint64(limit) - rate
 		}
 
-		w.Header().Set("X-Ratelimit-Limit", fmt.Sprintf("%d", flags.HTTP.Limit))
+		w.Header().Set("X-Ratelimit-Limit", fmt.Sprintf("%d", limit))
 		w.Header().Set("X-Ratelimit-Remaining", fmt.Sprintf("%d", remaining))
 		w.Header().Set("X-Ratelimit-Reset", fmt.Sprintf("%d", remttl))
 
@@ -41,6 +166,69 @@ func rateHeaderMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// hitLimit counts n additional hits against the rate limit for the request,
+// for endpoints where a single request is the equivalent of multiple lookups
+// (e.g. batch lookups). The X-Ratelimit-* headers are updated accordingly.
+// If the limit has been exceeded, an error is written to the client and false
+// is returned.
+func hitLimit(w http.ResponseWriter, r *http.Request, n uint64) (ok bool) {
+	limit := rateLimit(r)
+	if limit <= 0 || n == 0 || rateExempt(r) {
+		return true
+	}
+
+	count, remttl := rateLimiter.Add(rateKey(r), n, limitInterval())
+
+	var remaining uint64
+	if count < uint64(limit) {
+		remaining = uint64(limit) - count
+	}
+
+	w.Header().Set("X-Ratelimit-Limit", fmt.Sprintf("%d", limit))
+	w.Header().Set("X-Ratelimit-Remaining", fmt.Sprintf("%d", remaining))
+	w.Header().Set("X-Ratelimit-Reset", fmt.Sprintf("%d", remttl))
+
+	if count > uint64(limit) {
+		limitExceeded(w, r)
+		return false
+	}
+
+	return true
+}
+
+// limitErrorResult is the response body for clients which have exceeded their
+// rate limit.
+type limitErrorResult struct {
+	XMLName    xml.Name  `json:"-" xml:"geoip"`
+	Error      *APIError `json:"error" xml:"error"`
+	Limit      int       `json:"limit" xml:"limit"`
+	Interval   int32     `json:"interval" xml:"interval"`
+	RetryAfter int       `json:"retry_after" xml:"retry_after"`
+}
+
+// limitExceeded responds to a client which has exceeded their rate limit,
+// based on the X-Ratelimit-* headers which have already been set.
+func limitExceeded(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(w.Header().Get("X-Ratelimit-Limit"))
+	reset, _ := strconv.Atoi(w.Header().Get("X-Ratelimit-Reset"))
+	if reset < 1 {
+		reset = 1
+	}
+
+	metricRateLimited.Inc()
+	logger.Printf("connection %s has hit rate limit (limit: %d, reset: %d)", r.RemoteAddr, limit, reset)
+
+	w.Header().Set("Retry-After", strconv.Itoa(reset))
+
+	apiErr := newAPIError(r, errCodeRateLimited, "%s", httprl.ErrLimitExceeded)
+	writeError(w, r, http.StatusTooManyRequests, apiErr, &limitErrorResult{
+		Error:      apiErr,
+		Limit:      limit,
+		Interval:   limitInterval(),
+		RetryAfter: reset,
+	})
+}
+
 // MapLimiter is a rate limiter implementation for github.com/go-web/httprl
 // which is like the builtin Map limiter, but allows querying the current
 // limit and expiration time.
@@ -82,6 +270,33 @@ func (m *MapLimiter) Get(key string, ttlsec int32) (count uint64, remttl int32)
 	return v.Count, int32(rttl)
 }
 
+// Len returns the number of keys currently being tracked.
+func (m *MapLimiter) Len() int {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return len(m.s)
+}
+
+// Add is like Hit, however it counts n hits against the key at once.
+func (m *MapLimiter) Add(key string, n uint64, ttlsec int32) (count uint64, remttl int32) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	v, ok := m.s[key]
+	if !ok {
+		m.s[key] = &rldata{
+			Count:  n,
+			Expire: time.Now().Add(time.Duration(ttlsec) * time.Second),
+		}
+		return n, ttlsec
+	}
+	v.Count += n
+	rttl := v.Expire.Sub(time.Now()).Seconds()
+	if rttl < 1 {
+		return v.Count, 0
+	}
+	return v.Count, int32(rttl)
+}
+
 // Hit implements the httprl.Backend interface.
 func (m *MapLimiter) Hit(key string, ttlsec int32) (count uint64, remttl int32, err error) {
 	m.m.Lock()
@@ -0,0 +1,247 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// accessLogEntry is a single structured access log entry.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Duration  float64   `json:"duration_ms"`
+	ClientIP  string    `json:"client_ip"`
+	ClientCN  string    `json:"client_cn,omitempty"`
+	Bytes     int       `json:"bytes"`
+	DBType    string    `json:"db_type,omitempty"`
+}
+
+// jsonLogger returns a middleware (replacing middleware.Logger) which writes
+// one json object per request to out.
+func jsonLogger(out io.Writer) func(next http.Handler) http.Handler {
+	var mu sync.Mutex
+	enc := json.NewEncoder(out)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			defer func() {
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+
+				entry := accessLogEntry{
+					Time:      started,
+					RequestID: middleware.GetReqID(r.Context()),
+					Method:    r.Method,
+					Path:      redactIPs(r.URL.Path),
+					Proto:     r.Proto,
+					Status:    status,
+					Duration:  float64(time.Since(started).Microseconds()) / 1000,
+					ClientIP:  redactIPs(clientIP(r)),
+					ClientCN:  clientCN(r),
+					Bytes:     ww.BytesWritten(),
+					DBType:    ww.Header().Get("X-Maxmind-Type"),
+				}
+
+				if !logSampled(status) {
+					return
+				}
+
+				mu.Lock()
+				_ = enc.Encode(entry)
+				mu.Unlock()
+			}()
+
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
+
+// reRequestID matches request ids which are safe to accept from clients (and
+// write to logs).
+var reRequestID = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+// requestID assigns each request a unique id (or uses the X-Request-ID header
+// supplied by the client, if valid), and echoes it back in the X-Request-ID
+// response header.
+func requestID(next http.Handler) http.Handler {
+	echo := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get(middleware.RequestIDHeader); id != "" && !reRequestID.MatchString(id) {
+			r.Header.Del(middleware.RequestIDHeader)
+		}
+
+		echo.ServeHTTP(w, r)
+	})
+}
+
+// clientCN returns the common name of the verified client certificate, when
+// using mutual tls.
+func clientCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// logSampled returns true if the access log entry of a request with the
+// provided status should be written. Errors (including rate limited requests)
+// are always logged, and only --http.log-sample-rate of all other requests
+// are.
+func logSampled(status int) bool {
+	if status >= 400 || flags.HTTP.LogSampleRate >= 1 {
+		return true
+	}
+
+	return rand.Float64() < flags.HTTP.LogSampleRate
+}
+
+// sampledLogFormatter wraps a middleware.LogFormatter, only writing the
+// entries of sampled requests.
+type sampledLogFormatter struct {
+	middleware.LogFormatter
+}
+
+func (f *sampledLogFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	return &sampledLogEntry{LogEntry: f.LogFormatter.NewLogEntry(r)}
+}
+
+type sampledLogEntry struct {
+	middleware.LogEntry
+}
+
+func (e *sampledLogEntry) Write(status, bytes int, header http.Header, elapsed time.Duration, extra interface{}) {
+	if logSampled(status) {
+		e.LogEntry.Write(status, bytes, header, elapsed, extra)
+	}
+}
+
+// reIPCandidate matches substrings which may be an ip address.
+var reIPCandidate = regexp.MustCompile(`[0-9A-Fa-f:.]*[:.][0-9A-Fa-f:.]*`)
+
+// redactIPs replaces each ip address within s with its keyed hash, if enabled
+// with --http.log-redact-ip.
+func redactIPs(s string) string {
+	if !flags.HTTP.LogRedactIP {
+		return s
+	}
+
+	return reIPCandidate.ReplaceAllStringFunc(s, func(candidate string) string {
+		var suffix string
+
+		// The candidate may include the start of a format extension (e.g.
+		// "8.8.8.8.c" of "/api/8.8.8.8.csv"), as the extension may start
+		// with hex letters.
+		if net.ParseIP(candidate) == nil {
+			i := strings.LastIndexByte(candidate, '.')
+			if i < 0 || net.ParseIP(candidate[:i]) == nil {
+				return candidate
+			}
+
+			candidate, suffix = candidate[:i], candidate[i:]
+		}
+
+		return hashIP(candidate) + suffix
+	})
+}
+
+// hashIP returns the keyed hash (hmac-sha256, with --http.log-redact-secret)
+// of an address, which is used wherever addresses are redacted (access logs,
+// traces and streamed lookups), so they can be correlated with each other
+// without exposing the address. Unlike a plain hash, it can't be reversed
+// by hashing every possible address without the secret.
+func hashIP(addr string) string {
+	mac := hmac.New(sha256.New, []byte(flags.HTTP.LogRedactSecret))
+	mac.Write([]byte(addr))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// redactURI is like redactIPs, however the query of uri is decoded first, so
+// encoded addresses are also replaced.
+func redactURI(uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return redactIPs(uri)
+	}
+
+	query := u.Query()
+	for _, values := range query {
+		for i := 0; i < len(values); i++ {
+			values[i] = redactIPs(values[i])
+		}
+	}
+
+	u.Path, u.RawPath, u.RawQuery = redactIPs(u.Path), "", query.Encode()
+	return u.RequestURI()
+}
+
+// redactingLogFormatter wraps a middleware.LogFormatter, replacing the ip
+// addresses of the request before the entry is created (see redactIPs).
+type redactingLogFormatter struct {
+	middleware.LogFormatter
+}
+
+func (f *redactingLogFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	redacted := r.WithContext(r.Context())
+	redacted.RemoteAddr = redactIPs(clientIP(r))
+	redacted.RequestURI = redactURI(r.RequestURI)
+
+	return f.LogFormatter.NewLogEntry(redacted)
+}
+
+// accessLogger returns the configured access logging middleware.
+func accessLogger() func(next http.Handler) http.Handler {
+	if flags.HTTP.JSONLog {
+		return jsonLogger(os.Stdout)
+	}
+
+	if flags.HTTP.LogSampleRate >= 1 && !flags.HTTP.LogRedactIP {
+		return middleware.Logger
+	}
+
+	var formatter middleware.LogFormatter = &middleware.DefaultLogFormatter{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}
+
+	if flags.HTTP.LogRedactIP {
+		formatter = &redactingLogFormatter{LogFormatter: formatter}
+	}
+
+	if flags.HTTP.LogSampleRate < 1 {
+		formatter = &sampledLogFormatter{LogFormatter: formatter}
+	}
+
+	return middleware.RequestLogger(formatter)
+}
@@ -0,0 +1,57 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactIPs(t *testing.T) {
+	flags.HTTP.LogRedactIP = true
+	flags.HTTP.LogRedactSecret = "secret"
+	defer func() {
+		flags.HTTP.LogRedactIP = false
+		flags.HTTP.LogRedactSecret = ""
+	}()
+
+	tests := []struct {
+		in     string
+		ip     string // The address which must not be in the output.
+		suffix string // The remainder of the path which must be kept.
+	}{
+		{in: "/api/8.8.8.8", ip: "8.8.8.8"},
+		{in: "/api/8.8.8.8.json", ip: "8.8.8.8", suffix: ".json"},
+		{in: "/api/8.8.8.8.csv", ip: "8.8.8.8", suffix: ".csv"},
+		{in: "/api/8.8.8.8.xml", ip: "8.8.8.8", suffix: ".xml"},
+		{in: "/api/8.8.8.8.txt", ip: "8.8.8.8", suffix: ".txt"},
+		{in: "/api/2001:db8::1", ip: "2001:db8::1"},
+		{in: "/api/2001:db8::1.json", ip: "2001:db8::1", suffix: ".json"},
+		{in: "/api/2001:db8::1.csv", ip: "2001:db8::1", suffix: ".csv"},
+		{in: "/api/lookup/203.0.113.0/24", ip: "203.0.113.0", suffix: "/24"},
+	}
+
+	for _, tt := range tests {
+		out := redactIPs(tt.in)
+		if strings.Contains(out, tt.ip) {
+			t.Errorf("redactIPs(%q) = %q, address not redacted", tt.in, out)
+		}
+
+		if !strings.HasSuffix(out, tt.suffix) {
+			t.Errorf("redactIPs(%q) = %q, want suffix %q", tt.in, out, tt.suffix)
+		}
+	}
+
+	// Addresses must be redacted consistently, with or without an extension.
+	if a, b := redactIPs("/api/8.8.8.8"), redactIPs("/api/8.8.8.8.json"); a+".json" != b {
+		t.Errorf("inconsistent redaction: %q vs %q", a, b)
+	}
+
+	for _, in := range []string{"/api/example.com", "/api/example.com.json", "/api/version"} {
+		if out := redactIPs(in); out != in {
+			t.Errorf("redactIPs(%q) = %q, want unchanged", in, out)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/bluele/gcache"
+)
+
+// Statuses of a lookup against the lookup cache, as returned in the X-Cache
+// header. Bypass means the cache was unavailable, and wasn't used.
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheBypass = "BYPASS"
+)
+
+// errCacheMiss is returned by a resultCache when a key isn't cached.
+var errCacheMiss = errors.New("cache miss")
+
+// resultCache stores lookup results, keyed by the lookup (see lookupAddr).
+type resultCache interface {
+	// Get returns the cached result for key, or errCacheMiss if it isn't
+	// cached. Other errors mean the cache is unavailable.
+	Get(key string) (*AddrResult, error)
+	Set(key string, result *AddrResult) error
+	// Len returns the number of cached results, or 0 if it isn't tracked.
+	Len() int
+}
+
+// memoryCache is a resultCache which stores results in-memory.
+type memoryCache struct {
+	cache gcache.Cache
+}
+
+// newMemoryCache returns a memoryCache of size results, with the eviction
+// policy of --cache.policy.
+func newMemoryCache(size int) *memoryCache {
+	builder := gcache.New(size).ARC()
+	if flags.Cache.Policy == "lru" {
+		builder = gcache.New(size).LRU()
+	}
+
+	return &memoryCache{cache: builder.Expiration(flags.Cache.Expire).Build()}
+}
+
+func (c *memoryCache) Get(key string) (*AddrResult, error) {
+	value, err := c.cache.GetIFPresent(key)
+	if err == gcache.KeyNotFoundError {
+		return nil, errCacheMiss
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result, _ := value.(AddrResult)
+	return &result, nil
+}
+
+func (c *memoryCache) Set(key string, result *AddrResult) error {
+	return c.cache.Set(key, *result)
+}
+
+func (c *memoryCache) Len() int {
+	return c.cache.Len(false)
+}
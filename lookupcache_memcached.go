@@ -0,0 +1,90 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/lrstanley/geoip/geoip"
+)
+
+// memcachedTimeout is the max duration of a single cache operation against
+// memcached, so a slow memcached server doesn't slow down all lookups.
+const memcachedTimeout = 500 * time.Millisecond
+
+// MemcachedCache is a resultCache which stores results (as json) in
+// memcached, allowing them to be shared across multiple instances.
+type MemcachedCache struct {
+	client *memcache.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// NewMemcachedCache creates a new MemcachedCache, using the provided servers
+// (in host:port form), with results expiring after ttl.
+func NewMemcachedCache(servers []string, ttl time.Duration) *MemcachedCache {
+	client := memcache.New(servers...)
+	client.Timeout = memcachedTimeout
+
+	return &MemcachedCache{
+		client: client,
+		prefix: "geoip:lookup:",
+		ttl:    ttl,
+	}
+}
+
+// key returns the memcached key for key. Lookup keys may be longer than
+// memcached allows, or contain characters it doesn't, so they are hashed.
+func (c *MemcachedCache) key(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return c.prefix + hex.EncodeToString(sum[:])
+}
+
+func (c *MemcachedCache) Get(key string) (*AddrResult, error) {
+	item, err := c.client.Get(c.key(key))
+	if err == memcache.ErrCacheMiss {
+		return nil, errCacheMiss
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result AddrResult
+	if err = json.Unmarshal(item.Value, &result); err != nil {
+		return nil, err
+	}
+
+	// Only the offset at the time of the lookup is stored, so it's updated
+	// in case the time zone has changed offset (e.g. daylight saving time)
+	// since.
+	if offset := geoip.ZoneOffset(result.Timezone); offset != nil {
+		result.UTCOffset = offset
+	}
+
+	return &result, nil
+}
+
+func (c *MemcachedCache) Set(key string, result *AddrResult) error {
+	value, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return c.client.Set(&memcache.Item{
+		Key:        c.key(key),
+		Value:      value,
+		Expiration: int32(c.ttl / time.Second),
+	})
+}
+
+// Len implements resultCache. Entries stored in memcached aren't tracked.
+func (c *MemcachedCache) Len() int {
+	return 0
+}
@@ -13,12 +13,14 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"runtime"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/bluele/gcache"
 	gflags "github.com/jessevdk/go-flags"
+	"github.com/lrstanley/geoip/geoip"
 )
 
 // Should be automatically added by goreleaser.
@@ -29,26 +31,97 @@ var (
 )
 
 type Flags struct {
-	Debug          bool          `env:"DEBUG" short:"d" long:"debug" description:"enable exception display and pprof endpoints (warn: dangerous)"`
-	Quiet          bool          `env:"QUIET" short:"q" long:"quiet" description:"disable verbose output"`
-	DBPath         string        `env:"DB_PATH" long:"db" description:"path to read/store Maxmind DB" default:"geoip.db"`
-	UpdateInterval time.Duration `env:"UPDATE_INTERVAL" long:"interval" description:"interval of time between database update checks" default:"12h"`
-	UpdateURL      string        `env:"MAXMIND_UPDATE_URL" long:"update-url" description:"maxmind database file download location (must be gzipped)" default:"https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-City&license_key=%s&suffix=tar.gz"`
-	LicenseKey     string        `env:"MAXMIND_LICENSE_KEY" long:"license-key" description:"maxmind license key (must register for a maxmind account)" required:"true"`
-	Cache          struct {
-		Size   int           `env:"CACHE_SIZE" long:"size" description:"total number of lookups to keep in ARC cache (50% most recent, 50% most requested)" default:"500"`
-		Expire time.Duration `env:"CACHE_EXPIRE" long:"expire" description:"expiration time of cache" default:"20m"`
+	Debug              bool          `env:"DEBUG" short:"d" long:"debug" description:"enable exception display and pprof endpoints (warn: dangerous)"`
+	Quiet              bool          `env:"QUIET" short:"q" long:"quiet" description:"disable verbose output"`
+	DBPath             string        `env:"DB_PATH" long:"db" description:"path to read/store Maxmind DB (or http(s):// or s3://bucket/key url to fetch it from, re-fetched every --watch-interval if changed)" default:"geoip.db"`
+	Vendor             string        `env:"DB_VENDOR" long:"vendor" description:"vendor/format of --db (dbip: DB-IP mmdb databases; ip2location: IP2Location BIN databases; optional databases are always Maxmind)" choice:"maxmind" choice:"dbip" choice:"ip2location" default:"maxmind"`
+	ASNPath            string        `env:"ASN_DB_PATH" long:"asn-db" description:"path to read Maxmind ASN DB (optional, enables asn lookups, and ?include=asn)"`
+	AnonymousPath      string        `env:"ANONYMOUS_DB_PATH" long:"anonymous-db" description:"path to read Maxmind Anonymous IP DB (optional, enables anonymous/proxy detection, and ?include=anonymous)"`
+	ISPPath            string        `env:"ISP_DB_PATH" long:"isp-db" description:"path to read Maxmind ISP DB (optional, enables isp/organization lookups, and ?include=isp)"`
+	ConnectionTypePath string        `env:"CONNECTION_TYPE_DB_PATH" long:"connection-type-db" description:"path to read Maxmind Connection-Type DB (optional, enables connection type detection with ?include=connection)"`
+	DatacenterList     string        `env:"DATACENTER_LIST" long:"datacenter-list" description:"path to a file of asn organizations (one per line, case-insensitive substring match, or exact if prefixed with \"=\") considered datacenter/hosting providers for is_datacenter (replaces the embedded default list)"`
+	ResolverList       string        `env:"RESOLVER_LIST" long:"resolver-list" description:"path to a file of networks of large public dns resolvers, in \"<cidr> <operator>\" form (one per line), flagged by /api/resolver/<addr> (replaces the embedded default list of google, cloudflare and quad9 networks)"`
+	SelfTest           string        `env:"SELF_TEST" long:"self-test" description:"look up well-known addresses when the database is (re)loaded, to detect corrupt or wrong-edition databases (strict: refuse to use the database, so /readyz reports 503; warn: only log)" choice:"strict" choice:"warn" choice:"off" default:"warn"`
+	DBOpenTimeout      time.Duration `env:"DB_OPEN_TIMEOUT" long:"db-open-timeout" description:"if set, retry opening the database (with backoff) for up to this long before exiting, while the http server is already serving (/readyz reports 503 until it's open)"`
+	UpdateInterval     time.Duration `env:"UPDATE_INTERVAL" long:"interval" description:"interval of time between database update checks" default:"12h"`
+	WatchInterval      time.Duration `env:"WATCH_INTERVAL" long:"watch-interval" description:"interval of time between checks for database and tls certificate file changes (changed files are hot-reloaded)" default:"30s"`
+	UpdateURL          string        `env:"MAXMIND_UPDATE_URL" long:"update-url" description:"maxmind database file download location (must be gzipped, used when --account-id isn't provided)" default:"https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-City&license_key=%s&suffix=tar.gz"`
+	LicenseKey         string        `env:"MAXMIND_LICENSE_KEY" long:"license-key" description:"maxmind license key (must register for a maxmind account; if not provided, automatic updates are disabled)"`
+	AccountID          string        `env:"MAXMIND_ACCOUNT_ID" long:"account-id" description:"maxmind account id (if provided, database permalinks are used, and unchanged databases aren't re-downloaded)"`
+	Edition            string        `env:"MAXMIND_EDITION" long:"edition" description:"maxmind database edition to download (when using --account-id)" default:"GeoLite2-City"`
+	Cache              struct {
+		Size      int           `env:"CACHE_SIZE" long:"size" description:"total number of lookups to keep in the lookup cache" default:"500"`
+		Expire    time.Duration `env:"CACHE_EXPIRE" long:"expire" description:"expiration time of cache" default:"20m"`
+		Policy    string        `env:"CACHE_POLICY" long:"policy" description:"eviction policy of the lookup cache (arc: 50% most recent, 50% most requested; lru: least recently used)" choice:"arc" choice:"lru" default:"arc"`
+		Memcached []string      `env:"CACHE_MEMCACHED" env-delim:"," long:"memcached" description:"memcached server (host:port) to store lookups in instead of in-memory, to share them across instances (lookups continue uncached if unavailable; can be used multiple times)"`
 	} `group:"Cache Options" namespace:"cache"`
 	HTTP struct {
-		Bind     string   `env:"HTTP_BIND" short:"b" long:"bind" description:"address and port to bind to" default:":8080"`
-		Proxy    bool     `env:"HTTP_BEHIND_PROXY" long:"proxy" description:"obey X-Forwarded-For headers (warn: dangerous, make sure to only bind to localhost)"`
-		Throttle int      `env:"HTTP_THROTTLE" long:"throttle" description:"limit total max concurrent requests across all connections"`
-		Limit    int      `env:"HTTP_LIMIT" long:"limit" description:"number of requests/ip/hour" default:"2000"`
-		CORS     []string `env:"HTTP_CORS" long:"cors" description:"cors origin domain to allow with https?:// prefix (empty => '*'; use flag multiple times)"`
-		TLS      struct {
-			Use  bool   `env:"TLS_USE" long:"use" description:"enable tls"`
-			Cert string `env:"TLS_CERT" long:"cert" description:"path to ssl certificate"`
-			Key  string `env:"TLS_KEY" long:"key" description:"path to ssl key"`
+		Bind            string         `env:"HTTP_BIND" short:"b" long:"bind" description:"address and port to bind to (or unix:/path/to/socket to listen on a unix socket)" default:":8080"`
+		Proxy           bool           `env:"HTTP_BEHIND_PROXY" long:"proxy" description:"obey X-Forwarded-For headers (warn: dangerous, make sure to only bind to localhost)"`
+		APIOnly         bool           `env:"HTTP_API_ONLY" long:"api-only" description:"don't serve the embedded frontend, only the api (non-api paths return a 404)"`
+		DisableHostname bool           `env:"HTTP_DISABLE_HOSTNAME" long:"disable-hostname" description:"disable looking up hostnames (i.e. only allow ip addresses), which requires outbound dns"`
+		TrustedProxies  []string       `env:"HTTP_TRUSTED_PROXIES" env-delim:"," long:"trusted-proxy" description:"ip or cidr of a proxy whose X-Forwarded-For/X-Real-IP headers are obeyed (replaces --http.proxy; can be used multiple times)"`
+		MaxConcurrency  int            `env:"HTTP_MAX_CONCURRENCY" long:"max-concurrency" description:"max number of concurrently processed lookup requests (including batch lookups), after which requests are rejected with a 503 rather than queued (0 => GOMAXPROCS*4, -1 => unlimited)"`
+		Throttle        int            `env:"HTTP_THROTTLE" long:"throttle" description:"limit total max concurrent api lookups across all connections (excluding batch lookups)"`
+		ThrottleBatch   int            `env:"HTTP_THROTTLE_BATCH" long:"throttle-batch" description:"limit total max concurrent batch lookups across all connections"`
+		ThrottleTimeout time.Duration  `env:"HTTP_THROTTLE_TIMEOUT" long:"throttle-timeout" description:"max duration a throttled request may wait to be processed" default:"30s"`
+		Limit           int            `env:"HTTP_LIMIT" long:"limit" description:"number of requests/ip per limit interval" default:"2000"`
+		LimitInterval   time.Duration  `env:"HTTP_LIMIT_INTERVAL" long:"limit-interval" description:"interval of time (window) in which --http.limit applies (min: 1s)" default:"1h"`
+		Allowlist       []string       `env:"HTTP_ALLOWLIST" env-delim:"," long:"allowlist" description:"ip or cidr (ipv4 or ipv6) which is exempt from rate limiting (can be used multiple times)"`
+		Keys            map[string]int `env:"HTTP_API_KEYS" env-delim:"," long:"key" description:"api key (supplied via X-API-Key header) and its limit (per interval), in key:limit form, to allow higher limits for specific clients (can be used multiple times)"`
+		RedisURL        string         `env:"HTTP_REDIS_URL" long:"redis-url" description:"redis url (e.g. redis://localhost:6379/0) to store rate limits in, to share limits across instances (default: in-memory)"`
+		CORS            []string       `env:"HTTP_CORS" long:"cors" description:"cors origin domain to allow with https?:// prefix (empty => '*'; use flag multiple times)"`
+		CORSMethods     []string       `env:"HTTP_CORS_METHODS" env-delim:"," long:"cors-method" description:"http method to allow for cors requests (use flag multiple times)" default:"GET" default:"HEAD" default:"POST" default:"OPTIONS"`
+		CORSHeaders     []string       `env:"HTTP_CORS_HEADERS" env-delim:"," long:"cors-header" description:"request header to allow for cors requests, in addition to X-API-Key (use flag multiple times)" default:"Accept" default:"Content-Type"`
+		CORSCredentials bool           `env:"HTTP_CORS_CREDENTIALS" long:"cors-credentials" description:"allow credentials (cookies, authorization headers, etc) with cors requests (requires --http.cors, as '*' can't be used)"`
+		LangFallback    []string       `env:"HTTP_LANG_FALLBACK" env-delim:"," long:"lang-fallback" description:"language to use for names when the client doesn't request one, or a name isn't available in the requested language, in order of preference (can be used multiple times)" default:"en"`
+		EnrichRules     []string       `env:"HTTP_ENRICH_RULES" env-delim:";" long:"enrich-rule" description:"only do an enrichment (rdns, or an optional database) for matching results, in <enrichment>:<condition> form, where condition is country=US,CA, country!=US,CA, asn or !asn, e.g. rdns:country!=US (can be used multiple times; all rules of an enrichment must match)"`
+		ServerTiming    bool           `env:"HTTP_SERVER_TIMING" long:"server-timing" description:"add a Server-Timing header to api responses, with the time spent in the cache, database, rdns and enrichment (warn: exposes internal timing)"`
+		LookupMaxAge    time.Duration  `env:"HTTP_LOOKUP_MAX_AGE" long:"lookup-max-age" description:"allow successful lookups to be cached (e.g. by a cdn) for this duration, with Cache-Control: public, and Last-Modified of the database build for conditional requests (0 => responses aren't cached)"`
+		RequestTimeout  time.Duration  `env:"HTTP_REQUEST_TIMEOUT" long:"request-timeout" description:"max duration of a request, after which it is aborted and a 503 is returned (0 to disable)"`
+		ReadTimeout     time.Duration  `env:"HTTP_READ_TIMEOUT" long:"read-timeout" description:"max duration for reading an entire request, including the body (0 to disable)" default:"10s"`
+		WriteTimeout    time.Duration  `env:"HTTP_WRITE_TIMEOUT" long:"write-timeout" description:"max duration before timing out writes of the response (0 to disable)" default:"10s"`
+		IdleTimeout     time.Duration  `env:"HTTP_IDLE_TIMEOUT" long:"idle-timeout" description:"max duration to wait for the next request on keep-alive connections (0 uses --http.read-timeout)"`
+		DeepHealthcheck bool           `env:"HTTP_DEEP_HEALTHCHECK" long:"deep-healthcheck" description:"have /readyz also look up --http.healthcheck-ip in the database (bypassing the lookup cache), reporting 503 if it errors or has no results (/healthz is unaffected)"`
+		HealthcheckIP   string         `env:"HTTP_HEALTHCHECK_IP" long:"healthcheck-ip" description:"canary address looked up by --http.deep-healthcheck, which must have a record in the database" default:"8.8.8.8"`
+		ShutdownDelay   time.Duration  `env:"HTTP_SHUTDOWN_DELAY" long:"shutdown-delay" description:"duration to keep serving requests (while failing readiness checks) after a shutdown signal, before closing listeners"`
+		ShutdownTimeout time.Duration  `env:"HTTP_SHUTDOWN_TIMEOUT" long:"shutdown-timeout" description:"max duration to wait for in-flight requests to complete during shutdown" default:"15s"`
+		CompressLevel   int            `env:"HTTP_COMPRESS_LEVEL" long:"compress-level" description:"compression level of responses (1-9; higher is smaller but slower)" default:"5"`
+		CompressAlgos   []string       `env:"HTTP_COMPRESS_ALGOS" env-delim:"," long:"compress-algo" description:"compression algorithm to offer for responses, preferred in the order zstd, br, gzip, deflate (use flag multiple times)" choice:"zstd" choice:"br" choice:"gzip" choice:"deflate" default:"zstd" default:"br" default:"gzip" default:"deflate"`
+		JSONLog         bool           `env:"HTTP_JSON_LOG" long:"json-log" description:"write access logs as json (one object per request)"`
+		LogSampleRate   float64        `env:"HTTP_LOG_SAMPLE_RATE" long:"log-sample-rate" description:"fraction (0.0-1.0) of successful requests to write access logs for (errors, including rate limited requests, are always logged)" default:"1"`
+		LogRedactIP     bool           `env:"HTTP_LOG_REDACT_IP" long:"log-redact-ip" description:"replace ip addresses (of the client, and in the request path/query) in access logs with a keyed hash (hmac-sha256), so entries can be correlated without exposing addresses (requires --http.log-redact-secret)"`
+		LogRedactSecret string         `env:"HTTP_LOG_REDACT_SECRET" long:"log-redact-secret" description:"secret key of the hash of addresses (hmac-sha256) used by --http.log-redact-ip, --http.otlp-hash-ip and --stream.kafka-broker"`
+		OTLPEndpoint    string         `env:"HTTP_OTLP_ENDPOINT" long:"otlp-endpoint" description:"otlp/http endpoint url (e.g. http://localhost:4318) to export request traces to (default: tracing disabled)"`
+		OTLPHashIP      bool           `env:"HTTP_OTLP_HASH_IP" long:"otlp-hash-ip" description:"hash looked up addresses (hmac-sha256) before adding them to traces (requires --http.log-redact-secret)"`
+		BasicAuth       string         `env:"HTTP_BASIC_AUTH" long:"basic-auth" description:"require http basic authentication for the api, with the provided user:pass, or the users of a htpasswd file at the provided path (bcrypt or sha1 hashes; the health and admin endpoints are unaffected)"`
+		PublicPing      bool           `env:"HTTP_PUBLIC_PING" long:"public-ping" description:"don't require --http.basic-auth for /api/ping"`
+		AdminToken      string         `env:"HTTP_ADMIN_TOKEN" long:"admin-token" description:"bearer token required to use the admin endpoints, e.g. POST /api/admin/reload (empty => admin endpoints are disabled)"`
+		Metrics         bool           `env:"HTTP_METRICS" long:"metrics" description:"enable the prometheus /metrics endpoint"`
+		CIDRMaxV4       int            `env:"HTTP_CIDR_MAX_V4" long:"cidr-max-v4" description:"widest ipv4 prefix length allowed for network (cidr) lookups" default:"16"`
+		CIDRMaxV6       int            `env:"HTTP_CIDR_MAX_V6" long:"cidr-max-v6" description:"widest ipv6 prefix length allowed for network (cidr) lookups" default:"48"`
+		RangeMax        int64          `env:"HTTP_RANGE_MAX" long:"range-max" description:"max number of addresses an ip range (start-end) lookup may span" default:"65536"`
+		CIDRMaxResults  int            `env:"HTTP_CIDR_MAX_RESULTS" long:"cidr-max-results" description:"max number of network blocks returned for network (cidr) lookups" default:"1000"`
+		BatchMax        int            `env:"HTTP_BATCH_MAX" long:"batch-max" description:"max number of addresses allowed in a single batch lookup" default:"100"`
+		FieldStyle      string         `env:"HTTP_FIELD_STYLE" long:"field-style" description:"naming of the fields of json lookup responses (maxmind: the default names, e.g. country_abbr and latitude; flat: an alias of maxmind, as its fields are already flat; legacy: the camelCase names of the previous api, e.g. countryCode and lat/lon)" choice:"maxmind" choice:"flat" choice:"legacy" default:"maxmind"`
+		MaxBodyBytes    int64          `env:"HTTP_MAX_BODY_BYTES" long:"max-body-bytes" description:"max size (in bytes) of api request bodies, e.g. batch lookups (0 = unlimited)" default:"1048576"`
+		BatchStreamMax  int            `env:"HTTP_BATCH_STREAM_MAX" long:"batch-stream-max" description:"max number of addresses allowed in a single streaming (ndjson) batch lookup" default:"50000"`
+		BatchWorkers    int            `env:"HTTP_BATCH_WORKERS" long:"batch-workers" description:"number of concurrent lookups for each streaming (ndjson) batch lookup" default:"8"`
+		WSMaxConns      int            `env:"HTTP_WS_MAX_CONNS" long:"ws-max-conns" description:"max number of concurrent websocket connections (/api/self/ws) across all clients (0 disables websockets)" default:"100"`
+		WSMaxLifetime   time.Duration  `env:"HTTP_WS_MAX_LIFETIME" long:"ws-max-lifetime" description:"max duration of a websocket connection, after which it is closed (clients should reconnect)" default:"1h"`
+		WSInterval      time.Duration  `env:"HTTP_WS_INTERVAL" long:"ws-interval" description:"interval at which the geolocation is pushed over websocket connections, in addition to when the client sends a ping (min: 1s)" default:"30s"`
+		TLS             struct {
+			Use          bool     `env:"TLS_USE" long:"use" description:"enable tls"`
+			Cert         string   `env:"TLS_CERT" long:"cert" description:"path to ssl certificate"`
+			Key          string   `env:"TLS_KEY" long:"key" description:"path to ssl key"`
+			ClientCA     string   `env:"TLS_CLIENT_CA" long:"client-ca" description:"path to a ca certificate bundle; if provided, clients must present a certificate signed by it (mutual tls)"`
+			Hosts        []string `env:"TLS_HOSTS" env-delim:"," long:"host" description:"hostname to automatically obtain certificates for via acme/let's encrypt (replaces --http.tls.cert/key; can be used multiple times)"`
+			ACMECache    string   `env:"TLS_ACME_CACHE" long:"acme-cache" description:"directory to cache acme certificates in" default:"acme-cache"`
+			ACMEEmail    string   `env:"TLS_ACME_EMAIL" long:"acme-email" description:"contact email for the acme account (optional)"`
+			ACMEBind     string   `env:"TLS_ACME_BIND" long:"acme-bind" description:"address and port to answer acme http-01 challenges on" default:":80"`
+			HTTP3        bool     `env:"TLS_HTTP3" long:"http3" description:"additionally serve http/3 (quic) on the same address (udp)"`
+			Redirect     bool     `env:"TLS_REDIRECT" long:"redirect" description:"start a plain http listener which redirects all requests to https"`
+			RedirectBind string   `env:"TLS_REDIRECT_BIND" long:"redirect-bind" description:"address and port for the http to https redirect listener" default:":80"`
 		} `group:"TLS Options" namespace:"tls"`
 	} `group:"HTTP Options" namespace:"http"`
 	DNS struct {
@@ -56,15 +129,31 @@ type Flags struct {
 		Resolvers []string      `env:"DNS_RESOLVERS" long:"resolver" description:"resolver (in host:port form) to use for dns lookups (doesn't work with windows and plan9) (can be used multiple times)"`
 		Local     bool          `env:"DNS_LOCAL" long:"uselocal" description:"adds local (system) resolvers to the list of resolvers to use"`
 	} `group:"DNS Lookup Options" namespace:"dns"`
+	Breaker struct {
+		Threshold int           `env:"BREAKER_THRESHOLD" long:"threshold" description:"number of consecutive failures of an external dependency (e.g. the rdns resolver, or database downloads), after which it isn't used for --breaker.cooldown, and results are returned without it (0 disables)" default:"5"`
+		Cooldown  time.Duration `env:"BREAKER_COOLDOWN" long:"cooldown" description:"duration to stop using a failing dependency for, after which a single attempt is made to check if it has recovered" default:"30s"`
+	} `group:"Circuit Breaker Options" namespace:"breaker"`
+	Stream struct {
+		KafkaBrokers []string `env:"STREAM_KAFKA_BROKERS" env-delim:"," long:"kafka-broker" description:"kafka broker (host:port) to publish completed lookups (hashed ip, country, asn and timestamp) to (can be used multiple times; requires --http.log-redact-secret; default: disabled)"`
+		Topic        string   `env:"STREAM_TOPIC" long:"topic" description:"kafka topic to publish lookups to" default:"geoip-lookups"`
+		Buffer       int      `env:"STREAM_BUFFER" long:"buffer" description:"max number of lookups queued to be published, after which lookups are dropped" default:"10000"`
+	} `group:"Stream Options" namespace:"stream"`
 	Version bool `short:"v" long:"version" description:"print the version and compilation date"`
 }
 
 var (
-	flags    Flags
-	logger   = log.New(io.Discard, "", log.LstdFlags|log.Lshortfile)
-	db       *DB
-	arc      gcache.Cache
-	resolver *net.Resolver
+	flags           Flags
+	logger          = log.New(io.Discard, "", log.LstdFlags|log.Lshortfile)
+	db              *DB
+	asnDB           *DB
+	anonDB          *DB
+	ispDB           *DB
+	connDB          *DB
+	lookupCache     resultCache
+	ptrCache        gcache.Cache
+	rdnsBreaker     *breaker
+	downloadBreaker *breaker // Database updates and remote databases.
+	resolver        *net.Resolver
 )
 
 func main() {
@@ -75,6 +164,103 @@ func main() {
 		os.Exit(1)
 	}
 
+	for name, timeout := range map[string]time.Duration{
+		"--db-open-timeout":      flags.DBOpenTimeout,
+		"--http.lookup-max-age":  flags.HTTP.LookupMaxAge,
+		"--http.request-timeout": flags.HTTP.RequestTimeout,
+		"--http.read-timeout":    flags.HTTP.ReadTimeout,
+		"--http.write-timeout":   flags.HTTP.WriteTimeout,
+		"--http.idle-timeout":    flags.HTTP.IdleTimeout,
+	} {
+		if timeout < 0 {
+			fmt.Fprintf(os.Stderr, "error: %s must not be negative\n", name)
+			os.Exit(1)
+		}
+	}
+
+	if flags.HTTP.WSMaxConns > 0 && (flags.HTTP.WSMaxLifetime <= 0 || flags.HTTP.WSInterval < time.Second) {
+		fmt.Fprintln(os.Stderr, "error: --http.ws-max-lifetime must be positive, and --http.ws-interval must be at least 1s")
+		os.Exit(1)
+	}
+
+	if flags.HTTP.DeepHealthcheck && net.ParseIP(flags.HTTP.HealthcheckIP) == nil {
+		fmt.Fprintf(os.Stderr, "error: --http.healthcheck-ip %q is not a valid ip address\n", flags.HTTP.HealthcheckIP)
+		os.Exit(1)
+	}
+
+	if flags.HTTP.MaxConcurrency == 0 {
+		flags.HTTP.MaxConcurrency = runtime.GOMAXPROCS(0) * 4
+	}
+
+	if flags.HTTP.MaxConcurrency > 0 {
+		lookupSlots = make(chan struct{}, flags.HTTP.MaxConcurrency)
+	}
+
+	if flags.HTTP.LogSampleRate < 0 || flags.HTTP.LogSampleRate > 1 {
+		fmt.Fprintln(os.Stderr, "error: --http.log-sample-rate must be between 0.0 and 1.0")
+		os.Exit(1)
+	}
+
+	if len(flags.Stream.KafkaBrokers) > 0 && (flags.Stream.Topic == "" || flags.Stream.Buffer < 1) {
+		fmt.Fprintln(os.Stderr, "error: --stream.kafka-broker requires --stream.topic, and a --stream.buffer of at least 1")
+		os.Exit(1)
+	}
+
+	if flags.HTTP.LogRedactIP && flags.HTTP.LogRedactSecret == "" {
+		fmt.Fprintln(os.Stderr, "error: --http.log-redact-ip requires --http.log-redact-secret to be set")
+		os.Exit(1)
+	}
+
+	if flags.HTTP.OTLPHashIP && flags.HTTP.LogRedactSecret == "" {
+		fmt.Fprintln(os.Stderr, "error: --http.otlp-hash-ip requires --http.log-redact-secret to be set")
+		os.Exit(1)
+	}
+
+	if len(flags.Stream.KafkaBrokers) > 0 && flags.HTTP.LogRedactSecret == "" {
+		fmt.Fprintln(os.Stderr, "error: --stream.kafka-broker requires --http.log-redact-secret to be set, to hash streamed addresses")
+		os.Exit(1)
+	}
+
+	if flags.HTTP.CompressLevel < 1 || flags.HTTP.CompressLevel > 9 {
+		fmt.Fprintln(os.Stderr, "error: --http.compress-level must be between 1 and 9")
+		os.Exit(1)
+	}
+
+	if flags.HTTP.LimitInterval < time.Second {
+		fmt.Fprintln(os.Stderr, "error: --http.limit-interval must be at least 1s")
+		os.Exit(1)
+	}
+
+	// Per the CORS spec, credentials can't be used with a wildcard origin.
+	if flags.HTTP.CORSCredentials {
+		if len(flags.HTTP.CORS) == 0 {
+			fmt.Fprintln(os.Stderr, "error: --http.cors-credentials requires --http.cors to be set")
+			os.Exit(1)
+		}
+
+		for _, origin := range flags.HTTP.CORS {
+			if strings.Contains(origin, "*") {
+				fmt.Fprintln(os.Stderr, "error: --http.cors-credentials cannot be used with wildcard --http.cors origins")
+				os.Exit(1)
+			}
+		}
+	}
+
+	if strings.HasPrefix(flags.HTTP.Bind, "unix:") && flags.HTTP.TLS.Use {
+		fmt.Fprintln(os.Stderr, "error: --http.tls.use cannot be used when binding to a unix socket")
+		os.Exit(1)
+	}
+
+	if allowlist, err = parseNetworks(flags.HTTP.Allowlist); err != nil {
+		fmt.Fprintf(os.Stderr, "error: --http.allowlist: %s\n", err)
+		os.Exit(1)
+	}
+
+	if trustedProxies, err = parseNetworks(flags.HTTP.TrustedProxies); err != nil {
+		fmt.Fprintf(os.Stderr, "error: --http.trusted-proxy: %s\n", err)
+		os.Exit(1)
+	}
+
 	if flags.Version {
 		fmt.Printf("geoip version %q (compiled: %q, commit: %q)\n", version, date, commit)
 		os.Exit(0)
@@ -84,44 +270,169 @@ func main() {
 		logger.SetOutput(os.Stdout)
 	}
 
-	db = &DB{path: flags.DBPath}
-	arc = gcache.New(flags.Cache.Size).ARC().Expiration(flags.Cache.Expire).Build()
+	// Automatic updates download Maxmind databases, so would replace the
+	// database with one of a different format.
+	if flags.Vendor != geoip.VendorMaxMind && flags.LicenseKey != "" {
+		fmt.Fprintf(os.Stderr, "error: automatic updates (--license-key) are only supported with --vendor=%s\n", geoip.VendorMaxMind)
+		os.Exit(1)
+	}
+
+	if err = loadDatacenters(flags.DatacenterList); err != nil {
+		fmt.Fprintf(os.Stderr, "error: unable to load datacenter list %q: %s\n", flags.DatacenterList, err)
+		os.Exit(1)
+	}
+
+	if err = loadResolvers(flags.ResolverList); err != nil {
+		fmt.Fprintf(os.Stderr, "error: unable to load resolver list %q: %s\n", flags.ResolverList, err)
+		os.Exit(1)
+	}
+
+	if err = loadBasicAuth(flags.HTTP.BasicAuth); err != nil {
+		fmt.Fprintf(os.Stderr, "error: --http.basic-auth: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err = loadEnrichRules(flags.HTTP.EnrichRules); err != nil {
+		fmt.Fprintf(os.Stderr, "error: --http.enrich-rule: %s\n", err)
+		os.Exit(1)
+	}
+
+	downloadBreaker = newBreaker("download")
+	db = &DB{path: flags.DBPath, vendor: flags.Vendor, meta: mcache, check: selfTest}
+
+	// Remote databases must be available at startup (or within
+	// --db-open-timeout), as there is no local copy to fall back to.
+	if isRemotePath(flags.DBPath) {
+		if flags.LicenseKey != "" {
+			fmt.Fprintln(os.Stderr, "error: automatic updates (--license-key) cannot be used with a remote database url")
+			os.Exit(1)
+		}
+
+		if flags.DBOpenTimeout == 0 {
+			if err = db.load(); err != nil {
+				fmt.Fprintf(os.Stderr, "error: unable to load database %q: %s\n", displayPath(flags.DBPath), err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	go db.watch(flags.WatchInterval)
+
+	if flags.ASNPath != "" {
+		asnDB = &DB{path: flags.ASNPath, meta: asnMcache}
+		if err = asnDB.load(); err != nil {
+			logger.Printf("unable to load asn database %q: %s", displayPath(flags.ASNPath), err)
+		}
+		go asnDB.watch(flags.WatchInterval)
+	}
+
+	if flags.AnonymousPath != "" {
+		anonDB = &DB{path: flags.AnonymousPath, meta: anonMcache}
+		if err = anonDB.load(); err != nil {
+			logger.Printf("unable to load anonymous ip database %q: %s", displayPath(flags.AnonymousPath), err)
+		}
+		go anonDB.watch(flags.WatchInterval)
+	}
+
+	if flags.ISPPath != "" {
+		ispDB = &DB{path: flags.ISPPath, meta: ispMcache}
+		if err = ispDB.load(); err != nil {
+			logger.Printf("unable to load isp database %q: %s", displayPath(flags.ISPPath), err)
+		}
+		go ispDB.watch(flags.WatchInterval)
+	}
+
+	if flags.ConnectionTypePath != "" {
+		connDB = &DB{path: flags.ConnectionTypePath, meta: connMcache}
+		if err = connDB.load(); err != nil {
+			logger.Printf("unable to load connection type database %q: %s", displayPath(flags.ConnectionTypePath), err)
+		}
+		go connDB.watch(flags.WatchInterval)
+	}
+
+	if len(flags.Cache.Memcached) > 0 {
+		lookupCache = NewMemcachedCache(flags.Cache.Memcached, flags.Cache.Expire)
+	} else {
+		lookupCache = newMemoryCache(flags.Cache.Size)
+	}
+	ptrCache = gcache.New(flags.Cache.Size).LRU().Expiration(flags.Cache.Expire).Build()
 
 	if len(flags.DNS.Resolvers) == 0 {
 		resolver = net.DefaultResolver
 	} else {
 		resolver = &net.Resolver{PreferGo: true, Dial: customResolver}
 	}
+	rdnsBreaker = newBreaker("rdns")
 
-	go func() {
-		var needsUpdate bool
-		var err error
-		for {
-			logger.Println("checking for database updates")
-			needsUpdate, err = db.checkForUpdates()
-			if needsUpdate {
-				if err != nil {
-					logger.Printf("database needs update due to error (%s)", err)
-				} else {
-					logger.Println("database needs update")
-				}
+	if src := newUpdateSource(); src != nil {
+		go db.autoUpdate(src, flags.UpdateInterval)
+	} else {
+		logger.Println("no license key provided, automatic database updates disabled")
 
-				if err = db.update(flags.UpdateURL, flags.LicenseKey); err != nil {
-					logger.Println(err)
+		switch {
+		case flags.DBOpenTimeout > 0:
+			go func() {
+				if err := db.open(flags.DBOpenTimeout); err != nil {
+					fmt.Fprintf(os.Stderr, "error: unable to open database %q within %s: %s\n", displayPath(flags.DBPath), flags.DBOpenTimeout, err)
+					os.Exit(1)
 				}
-			} else {
-				logger.Println("no database updates needed")
-			}
+			}()
+		case !isRemotePath(flags.DBPath):
+			go func() {
+				if err := db.load(); err != nil {
+					logger.Printf("unable to load database %q: %s", flags.DBPath, err)
+				}
+			}()
+		}
+	}
 
-			time.Sleep(flags.UpdateInterval)
+	if flags.HTTP.OTLPEndpoint != "" {
+		var shutdownTracing func(context.Context) error
+
+		shutdownTracing, err = initTracing(context.Background())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: unable to initialize tracing: %s\n", err)
+			os.Exit(1)
 		}
-	}()
+
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := shutdownTracing(ctx); err != nil {
+				logger.Printf("error while flushing traces: %s", err)
+			}
+		}()
+	}
+
+	if len(flags.Stream.KafkaBrokers) > 0 {
+		lookupEvents = make(chan *lookupEvent, flags.Stream.Buffer)
+
+		// Stopped after the http server, so lookups of in-flight requests are
+		// still published.
+		streamCloser := make(chan struct{})
+		streamDone := make(chan struct{})
+		go func() {
+			runStream(streamCloser)
+			close(streamDone)
+		}()
+
+		defer func() {
+			close(streamCloser)
+			<-streamDone
+		}()
+	}
 
 	httpCloser := make(chan struct{})
-	go initHTTP(httpCloser)
+	httpDone := make(chan struct{})
+	go func() {
+		initHTTP(httpCloser)
+		close(httpDone)
+	}()
 
 	catch()
 	close(httpCloser)
+	<-httpDone
 	fmt.Println("exiting")
 }
 
@@ -132,6 +443,13 @@ func catch() {
 	fmt.Println("listening for signal. CTRL+C to quit.")
 	<-signals
 	fmt.Println("\ninvoked termination, cleaning up")
+
+	// A second signal skips the graceful shutdown.
+	go func() {
+		<-signals
+		fmt.Println("invoked termination again, exiting immediately")
+		os.Exit(1)
+	}()
 }
 
 func customResolver(ctx context.Context, network, address string) (net.Conn, error) {
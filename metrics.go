@@ -0,0 +1,143 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricHTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip_http_requests_total",
+		Help: "Total number of http requests, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	metricHTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "geoip_http_request_duration_seconds",
+		Help:    "Latency of http requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	metricLookups = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geoip_lookups_total",
+		Help: "Total number of address lookups.",
+	})
+
+	metricLookupStatus = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip_lookups_by_status_total",
+		Help: "Total number of address lookups, by result status.",
+	}, []string{"status"})
+
+	metricLookupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "geoip_lookup_duration_seconds",
+		Help:    "Latency of address lookups (including cache hits and enrichment).",
+		Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 2.5},
+	})
+
+	metricStreamDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip_stream_dropped_total",
+		Help: "Total number of lookups which weren't published to kafka, by reason (buffer_full or error).",
+	}, []string{"reason"})
+
+	metricBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "geoip_breaker_state",
+		Help: "State of the circuit breaker around an external dependency (0: closed, 1: half-open, 2: open).",
+	}, []string{"name"})
+
+	metricCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip_cache_requests_total",
+		Help: "Total number of lookup cache requests, by result (hit or miss).",
+	}, []string{"result"})
+
+	metricRateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geoip_ratelimit_rejections_total",
+		Help: "Total number of requests rejected due to rate limiting.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "geoip_cache_entries",
+		Help: "Number of entries in the lookup cache.",
+	}, func() float64 {
+		if lookupCache == nil {
+			return 0
+		}
+		return float64(lookupCache.Len())
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "geoip_lookups_in_flight",
+		Help: "Number of lookup requests currently being processed (see --http.max-concurrency).",
+	}, func() float64 {
+		return float64(len(lookupSlots))
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "geoip_websocket_connections",
+		Help: "Number of currently open websocket connections.",
+	}, func() float64 {
+		return float64(wsConns.Load())
+	})
+)
+
+// registerLimiterMetrics registers the metrics of the in-memory rate limiter.
+// Entries of the redis backend aren't tracked, as they're shared across
+// instances.
+func registerLimiterMetrics() {
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "geoip_ratelimit_entries",
+		Help: "Number of clients currently tracked by the (in-memory) rate limiter.",
+	}, func() float64 {
+		return float64(mapLimiter.Len())
+	})
+}
+
+// Lookup result statuses, used for metrics.
+const (
+	statusSuccess  = "success"
+	statusNotFound = "not_found"
+	statusInvalid  = "invalid"
+	statusError    = "error"
+)
+
+// observeLookup records the metrics for a single address lookup.
+func observeLookup(started time.Time, status string) {
+	metricLookups.Inc()
+	metricLookupStatus.WithLabelValues(status).Inc()
+	metricLookupDuration.Observe(time.Since(started).Seconds())
+}
+
+// metricsMiddleware records the request count and latency of all http
+// requests, labeled by the matched route pattern (to prevent label
+// cardinality issues from e.g. addresses in the path).
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := "unknown"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			if pattern := rctx.RoutePattern(); pattern != "" {
+				route = pattern
+			}
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		metricHTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		metricHTTPDuration.WithLabelValues(route).Observe(time.Since(started).Seconds())
+	})
+}
@@ -46,7 +46,23 @@ export const utils = {
           response.body.query = address;
 
           resolve(response.body);
-        }, () => {
+        }, response => {
+          if (response.body && response.body.error != undefined) {
+            if (address == 'self') {
+              reject(null);
+              return;
+            }
+
+            if (response.body.error.reason == "not_found") {
+              reject("Error: No results found");
+              return;
+            }
+
+            let message = response.body.error.message;
+            reject("Error: " + message.charAt(0).toUpperCase() + message.slice(1));
+            return;
+          }
+
           reject("An unknown exception occurred or service unavailable");
           return
         });
@@ -0,0 +1,126 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// trustedProxies contains the networks of proxies whose forwarding headers
+// are obeyed.
+var trustedProxies []*net.IPNet
+
+type peerKey struct{}
+
+// withPeer stores the address of the connecting peer in the request context,
+// before it's replaced by the address from the forwarding headers.
+func withPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerKey{}, clientIP(r))))
+	})
+}
+
+// peerIP returns the address of the connecting peer of the request.
+func peerIP(r *http.Request) net.IP {
+	if peer, ok := r.Context().Value(peerKey{}).(string); ok {
+		return net.ParseIP(peer)
+	}
+
+	return net.ParseIP(clientIP(r))
+}
+
+// trustedRealIP is like middleware.RealIP, however forwarding headers are only
+// obeyed if the connecting peer is a trusted proxy.
+func trustedRealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if containsIP(trustedProxies, net.ParseIP(clientIP(r))) {
+			if ip := forwardedIP(r); ip != nil {
+				r.RemoteAddr = ip.String()
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedIP returns the client IP from the forwarding headers of a request
+// from a trusted proxy. X-Forwarded-For is walked from right to left (the
+// closest hop first), skipping any trusted proxies, as entries to the left of
+// the last trusted proxy can be spoofed by the client.
+func forwardedIP(r *http.Request) net.IP {
+	hops := forwardedHops(r)
+
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+		if !containsIP(trustedProxies, hop) {
+			break
+		}
+	}
+
+	if ip != nil {
+		return ip
+	}
+
+	return net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+}
+
+// forwardedHops returns the (unparsed) entries of the X-Forwarded-For headers
+// of a request, from left (the original client) to right.
+func forwardedHops(r *http.Request) (hops []string) {
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	return hops
+}
+
+// forwardedHop returns the address at (zero-based) index hop of the
+// X-Forwarded-For chain. With --http.trusted-proxy, the connecting peer and
+// every hop after the requested one must be a trusted proxy, as otherwise
+// the address could have been spoofed by the client. Returned errors are
+// safe to show to the user.
+func forwardedHop(r *http.Request, hop string) (net.IP, error) {
+	if len(trustedProxies) == 0 && !flags.HTTP.Proxy {
+		return nil, errors.New("forwarding headers are not obeyed")
+	}
+
+	hops := forwardedHops(r)
+
+	n, err := strconv.Atoi(hop)
+	if err != nil || n < 0 || n >= len(hops) {
+		return nil, fmt.Errorf("hop out of range (request has %d forwarded addresses)", len(hops))
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(hops[n]))
+	if ip == nil {
+		return nil, fmt.Errorf("hop %d is not a valid ip address", n)
+	}
+
+	if len(trustedProxies) > 0 {
+		if !containsIP(trustedProxies, peerIP(r)) {
+			return nil, fmt.Errorf("hop %d was not forwarded by a trusted proxy", n)
+		}
+
+		for i := n + 1; i < len(hops); i++ {
+			if !containsIP(trustedProxies, net.ParseIP(strings.TrimSpace(hops[i]))) {
+				return nil, fmt.Errorf("hop %d was not forwarded by a trusted proxy", n)
+			}
+		}
+	}
+
+	return ip, nil
+}
@@ -0,0 +1,198 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	awshttp "github.com/aws/smithy-go/transport/http"
+)
+
+// maxRemoteSize is the maximum size of a database fetched from a remote url.
+const maxRemoteSize = 1 << 30
+
+// remoteTimeout is the max duration of fetching a remote database.
+const remoteTimeout = 5 * time.Minute
+
+// isRemotePath returns true if path is a http(s):// or s3:// url, rather than
+// a path on disk.
+func isRemotePath(path string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://"} {
+		if len(path) > len(scheme) && strings.EqualFold(path[:len(scheme)], scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// displayPath returns path in a form which is safe to log, i.e. with any
+// credentials or query parameters (e.g. pre-signed url signatures) removed.
+func displayPath(path string) string {
+	if !isRemotePath(path) {
+		return path
+	}
+
+	u, err := url.Parse(path)
+	if err != nil {
+		return "<invalid url>"
+	}
+
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+// remoteObject is the contents of a remote database. If unchanged is true,
+// the database hasn't changed since it was last fetched, and buf is empty.
+type remoteObject struct {
+	buf       []byte
+	etag      string
+	modified  time.Time
+	unchanged bool
+}
+
+// fetchRemote fetches the database at uri. If the etag or modification time
+// of the previous fetch are provided, and the database hasn't changed since,
+// the returned object is marked as unchanged.
+func fetchRemote(uri, etag string, modified time.Time) (*remoteObject, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database url: %w", err)
+	}
+
+	if strings.EqualFold(u.Scheme, "s3") {
+		return fetchS3(ctx, u, etag, modified)
+	}
+
+	return fetchHTTP(ctx, uri, etag, modified)
+}
+
+func fetchHTTP(ctx context.Context, uri, etag string, modified time.Time) (*remoteObject, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	} else if !modified.IsZero() {
+		req.Header.Set("If-Modified-Since", modified.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Don't include the full url, which may contain credentials.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+
+		return nil, fmt.Errorf("unable to fetch database from %q: %w", displayPath(uri), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return &remoteObject{unchanged: true}, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from %q: %s", displayPath(uri), resp.Status)
+	}
+
+	obj := &remoteObject{etag: resp.Header.Get("ETag")}
+	obj.modified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	if obj.buf, err = readRemote(resp.Body); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+var (
+	s3Once   sync.Once
+	s3Client *s3.Client
+	s3Err    error
+)
+
+// fetchS3 fetches the database from s3, where u is in the form of
+// s3://bucket/key. Credentials and the region are resolved the same as the
+// aws cli (i.e. environment, shared config, or instance/container roles).
+func fetchS3(ctx context.Context, u *url.URL, etag string, modified time.Time) (*remoteObject, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid s3 url %q: must be in the form s3://bucket/key", u.Redacted())
+	}
+
+	s3Once.Do(func() {
+		var cfg aws.Config
+
+		cfg, s3Err = awsconfig.LoadDefaultConfig(ctx)
+		if s3Err == nil {
+			s3Client = s3.NewFromConfig(cfg)
+		}
+	})
+	if s3Err != nil {
+		return nil, fmt.Errorf("unable to load aws configuration: %w", s3Err)
+	}
+
+	input := &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	} else if !modified.IsZero() {
+		input.IfModifiedSince = aws.Time(modified)
+	}
+
+	out, err := s3Client.GetObject(ctx, input)
+	if err != nil {
+		var respErr *awshttp.ResponseError
+		if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified {
+			return &remoteObject{unchanged: true}, nil
+		}
+
+		return nil, fmt.Errorf("unable to fetch database from %q: %w", u.Redacted(), err)
+	}
+	defer out.Body.Close()
+
+	obj := &remoteObject{etag: aws.ToString(out.ETag)}
+	if out.LastModified != nil {
+		obj.modified = *out.LastModified
+	}
+
+	if obj.buf, err = readRemote(out.Body); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// readRemote reads the database from r, up to maxRemoteSize.
+func readRemote(r io.Reader) ([]byte, error) {
+	buf, err := io.ReadAll(io.LimitReader(r, maxRemoteSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading remote database: %w", err)
+	}
+
+	if len(buf) > maxRemoteSize {
+		return nil, fmt.Errorf("remote database exceeds max size of %d bytes", maxRemoteSize)
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// defaultResolvers is the default list of networks of large public dns
+// resolvers, used unless --resolver-list is provided.
+//
+//go:embed data/resolvers.txt
+var defaultResolvers string
+
+// publicResolver is a network of a large public dns resolver.
+type publicResolver struct {
+	network  *net.IPNet
+	operator string
+}
+
+var publicResolvers []publicResolver
+
+// loadResolvers loads the public resolver networks from the file at path, or
+// the embedded default list if path is empty.
+func loadResolvers(path string) error {
+	raw := defaultResolvers
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		raw = string(b)
+	}
+
+	publicResolvers = nil
+	for i, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		cidr, operator, _ := strings.Cut(line, " ")
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		publicResolvers = append(publicResolvers, publicResolver{
+			network:  network,
+			operator: strings.ToLower(strings.TrimSpace(operator)),
+		})
+	}
+
+	return nil
+}
+
+// resolverOperator returns the operator of the public resolver network addr
+// is within, and false if addr isn't a known public resolver.
+func resolverOperator(addr net.IP) (operator string, ok bool) {
+	for _, resolver := range publicResolvers {
+		if resolver.network.Contains(addr) {
+			return resolver.operator, true
+		}
+	}
+
+	return "", false
+}
+
+// ResolverResult is an AddrResult of a dns resolver, and if it appears to be
+// a large public resolver. The location of public resolvers (which are
+// generally anycast) is a poor estimate of the location of its clients.
+type ResolverResult struct {
+	XMLName xml.Name `json:"-" xml:"geoip"`
+	*AddrResult
+	IsPublicResolver bool   `json:"is_public_resolver" xml:"is_public_resolver"`
+	ResolverOperator string `json:"resolver_operator,omitempty" xml:"resolver_operator,omitempty"`
+}
+
+// apiResolverLookup looks up the address of a dns resolver, flagging it if
+// it's a known public resolver (see --resolver-list).
+func apiResolverLookup(w http.ResponseWriter, r *http.Request) {
+	addr := strings.TrimSpace(chi.URLParam(r, "addr"))
+	if net.ParseIP(addr) == nil {
+		errorResponse(w, r, http.StatusBadRequest, errCodeInvalidIP, "invalid ip address specified: %s", addr)
+		return
+	}
+
+	result, cache, err := lookupAddr(r.Context(), addr, newLookupOptions(w, r))
+	if err != nil {
+		errorResponse(w, r, http.StatusServiceUnavailable, errCodeDBUnavailable, "unable to query database")
+		return
+	}
+
+	w.Header().Set("X-Cache", cache)
+
+	if result.status != 0 {
+		errorResponse(w, r, result.status, result.code, "%s", result.Error)
+		return
+	}
+
+	if result.Error != "" {
+		errorResponse(w, r, http.StatusNotFound, errCodeNotFound, "no results found for %s", result.IP)
+		return
+	}
+
+	out := &ResolverResult{AddrResult: result}
+	out.ResolverOperator, out.IsPublicResolver = resolverOperator(result.IP)
+
+	if responseFormat(r) == formatXML {
+		xmlResponse(w, r, http.StatusOK, out)
+		return
+	}
+
+	jsonResponse(w, r, styleFields(out))
+}
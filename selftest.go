@@ -0,0 +1,66 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/lrstanley/geoip/geoip"
+)
+
+// selfTestAddrs are well-known public addresses (anycast resolvers), which
+// should have a record in any geolocation database.
+var selfTestAddrs = []string{
+	"8.8.8.8",
+	"1.1.1.1",
+	"9.9.9.9",
+	"2001:4860:4860::8888",
+}
+
+var errSelfTest = errors.New("self-test failed: none of the well-known test addresses have a country (corrupt database, or wrong edition?)")
+
+// selfTest looks up each of the self-test addresses in reader, verifying that
+// the expected fields (the country, and for city editions, the city) are
+// populated. Addresses which fail are logged, and an error is returned if
+// none pass, as that indicates the database is corrupt or the wrong edition
+// (e.g. an ASN database). With --self-test=warn, failures are only logged.
+func selfTest(reader *geoip.Reader) error {
+	if flags.SelfTest == "off" {
+		return nil
+	}
+
+	city := strings.Contains(strings.ToLower(reader.Metadata().DatabaseType), "city")
+
+	var passed int
+	for _, addr := range selfTestAddrs {
+		result, err := reader.Lookup(net.ParseIP(addr))
+
+		switch {
+		case errors.Is(err, geoip.ErrNotFound):
+			logger.Printf("self-test: %s has no record", addr)
+		case err != nil:
+			logger.Printf("self-test: lookup of %s failed: %s", addr, err)
+		case result.CountryCode == "":
+			logger.Printf("self-test: %s has no country", addr)
+		case city && result.City == "":
+			logger.Printf("self-test: %s has no city (database type: %s)", addr, reader.Metadata().DatabaseType)
+		default:
+			passed++
+		}
+	}
+
+	if passed > 0 {
+		return nil
+	}
+
+	if flags.SelfTest == "warn" {
+		logger.Printf("warning: %s", errSelfTest)
+		return nil
+	}
+
+	return errSelfTest
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type timingsKey struct{}
+
+// serverTimings accumulates the time spent in each stage (e.g. "db") of a
+// request. Stages may be timed more than once (e.g. for batch lookups, and
+// concurrently), in which case the durations are summed.
+type serverTimings struct {
+	started time.Time
+
+	mu     sync.Mutex
+	stages []string
+	totals map[string]time.Duration
+}
+
+// header returns the Server-Timing header value of the timings, in the
+// order the stages were first timed, followed by the total.
+func (t *serverTimings) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	metrics := make([]string, 0, len(t.stages)+1)
+	for _, stage := range t.stages {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", stage, ms(t.totals[stage])))
+	}
+
+	return strings.Join(append(metrics, fmt.Sprintf("total;dur=%.3f", ms(time.Since(t.started)))), ", ")
+}
+
+// ms returns d in (fractional) milliseconds, as used by Server-Timing.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// addTiming adds the time since started to the provided stage of the request
+// timings, if enabled with --http.server-timing.
+func addTiming(ctx context.Context, stage string, started time.Time) {
+	t, ok := ctx.Value(timingsKey{}).(*serverTimings)
+	if !ok {
+		return
+	}
+
+	elapsed := time.Since(started)
+
+	t.mu.Lock()
+	if _, ok = t.totals[stage]; !ok {
+		t.stages = append(t.stages, stage)
+	}
+	t.totals[stage] += elapsed
+	t.mu.Unlock()
+}
+
+// serverTiming adds a Server-Timing header to responses, with the time spent
+// in each stage of the request (see addTiming), when enabled with
+// --http.server-timing.
+func serverTiming(next http.Handler) http.Handler {
+	if !flags.HTTP.ServerTiming {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &serverTimings{started: time.Now(), totals: make(map[string]time.Duration)}
+
+		next.ServeHTTP(
+			&timingWriter{ResponseWriter: w, timings: t},
+			r.WithContext(context.WithValue(r.Context(), timingsKey{}, t)),
+		)
+	})
+}
+
+// timingWriter sets the Server-Timing header just before the response is
+// written.
+type timingWriter struct {
+	http.ResponseWriter
+	timings     *serverTimings
+	wroteHeader bool
+}
+
+func (w *timingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Server-Timing", w.timings.header())
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, for streamed responses.
+func (w *timingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, for websocket connections.
+func (w *timingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
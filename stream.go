@@ -0,0 +1,103 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// lookupEvent is a single completed lookup, as published to kafka.
+type lookupEvent struct {
+	Time        time.Time `json:"timestamp"`
+	IPHash      string    `json:"ip_hash"`
+	CountryCode string    `json:"country_abbr,omitempty"`
+	ASN         uint      `json:"autonomous_system_number,omitempty"`
+}
+
+// lookupEvents receives completed lookups to be published. nil if streaming
+// is disabled.
+var lookupEvents chan *lookupEvent
+
+// publishLookup queues a completed lookup to be published, if streaming is
+// enabled. If the buffer is full, the lookup is dropped rather than slowing
+// down the request.
+func publishLookup(result *AddrResult) {
+	if lookupEvents == nil {
+		return
+	}
+
+	event := &lookupEvent{
+		Time:        time.Now().UTC(),
+		IPHash:      hashIP(result.IP.String()),
+		CountryCode: result.CountryCode,
+		ASN:         result.ASN,
+	}
+
+	select {
+	case lookupEvents <- event:
+	default:
+		metricStreamDropped.WithLabelValues("buffer_full").Inc()
+	}
+}
+
+// runStream publishes completed lookups to --stream.kafka-broker
+// asynchronously, until closer is closed, after which queued lookups are
+// flushed.
+func runStream(closer chan struct{}) {
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(flags.Stream.KafkaBrokers...),
+		Topic:        flags.Stream.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: time.Second,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				logger.Printf("unable to publish %d lookups to kafka: %s", len(messages), err)
+				metricStreamDropped.WithLabelValues("error").Add(float64(len(messages)))
+			}
+		},
+	}
+
+	publish := func(event *lookupEvent) {
+		value, err := json.Marshal(event)
+		if err != nil {
+			logger.Printf("unable to encode lookup for kafka: %s", err)
+			metricStreamDropped.WithLabelValues("error").Inc()
+			return
+		}
+
+		// Lookups of the same address are kept within the same partition.
+		if err = writer.WriteMessages(context.Background(), kafka.Message{
+			Key:   []byte(event.IPHash),
+			Value: value,
+		}); err != nil {
+			logger.Printf("unable to publish lookup to kafka: %s", err)
+			metricStreamDropped.WithLabelValues("error").Inc()
+		}
+	}
+
+	logger.Printf("publishing lookups to kafka topic %q", flags.Stream.Topic)
+
+	for {
+		select {
+		case event := <-lookupEvents:
+			publish(event)
+		case <-closer:
+			// Publish the lookups which are still queued, before flushing.
+			for len(lookupEvents) > 0 {
+				publish(<-lookupEvents)
+			}
+
+			if err := writer.Close(); err != nil {
+				logger.Printf("error while flushing lookups to kafka: %s", err)
+			}
+			return
+		}
+	}
+}
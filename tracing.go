@@ -0,0 +1,134 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/lrstanley/geoip"
+
+// tracingEnabled is true if traces are being exported. When disabled, no
+// spans are created.
+var tracingEnabled bool
+
+// initTracing configures the otlp trace exporter, returning a function which
+// flushes and stops the exporter.
+func initTracing(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	endpoint, err := url.Parse(flags.HTTP.OTLPEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the default traces path, if only the collector address is provided.
+	if endpoint.Path == "" || endpoint.Path == "/" {
+		endpoint.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("geoip"),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	tracingEnabled = true
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware creates a span for each request, continuing any trace
+// propagated by the client. Spans are named after the matched route.
+func tracingMiddleware(next http.Handler) http.Handler {
+	named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			if pattern := rctx.RoutePattern(); pattern != "" {
+				trace.SpanFromContext(r.Context()).SetName(r.Method + " " + pattern)
+			}
+		}
+	})
+
+	return otelhttp.NewHandler(named, "geoip")
+}
+
+// startSpan starts a child span of the span in ctx, if tracing is enabled.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !tracingEnabled {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, recording err if non-nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceLookup adds the details of a lookup to the span in ctx.
+func traceLookup(ctx context.Context, addr string, cached bool) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+
+	if flags.HTTP.OTLPHashIP {
+		addr = hashIP(addr)
+	}
+
+	span.SetAttributes(
+		attribute.String("geoip.addr", addr),
+		attribute.Bool("geoip.cache_hit", cached),
+		attribute.String("geoip.db_type", dbType()),
+	)
+}
+
+// dbType returns the type of the loaded database, if any.
+func dbType() string {
+	mcache.RLock()
+	defer mcache.RUnlock()
+
+	if mcache.cache == nil {
+		return ""
+	}
+
+	return mcache.cache.DatabaseType
+}
@@ -0,0 +1,193 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// permalinkURL is the maxmind download permalink, which requires basic auth
+// with the account id and license key.
+const permalinkURL = "https://download.maxmind.com/geoip/databases/%s/download?suffix=%s"
+
+// updateSource describes where (and how) to fetch database updates from.
+type updateSource struct {
+	url       string // url of the gzipped tarball.
+	hashURL   string // url of the sha256 checksum of the tarball (optional).
+	accountID string // used for basic auth, if provided.
+	license   string
+}
+
+// newUpdateSource returns the update source based on the configured flags,
+// preferring maxmind permalinks (which support checksums), when an account id
+// is provided. Returns nil if no license key is configured, in which case
+// automatic updates are disabled.
+func newUpdateSource() *updateSource {
+	if flags.LicenseKey == "" {
+		return nil
+	}
+
+	if flags.AccountID != "" {
+		edition := url.PathEscape(flags.Edition)
+
+		return &updateSource{
+			url:       fmt.Sprintf(permalinkURL, edition, "tar.gz"),
+			hashURL:   fmt.Sprintf(permalinkURL, edition, "tar.gz.sha256"),
+			accountID: flags.AccountID,
+			license:   flags.LicenseKey,
+		}
+	}
+
+	return &updateSource{url: fmt.Sprintf(flags.UpdateURL, flags.LicenseKey)}
+}
+
+// get fetches uri, with authentication if necessary. The caller must close
+// the response body.
+func (s *updateSource) get(uri string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.accountID != "" {
+		req.SetBasicAuth(s.accountID, s.license)
+	}
+
+	// If the source is failing, updates are skipped (continuing to use the
+	// current database) until the breaker closes again.
+	var resp *http.Response
+
+	err = downloadBreaker.call(func() error {
+		if resp, err = http.DefaultClient.Do(req); err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("unexpected status code from %q: %s", req.URL.Redacted(), resp.Status)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// remoteHash fetches the sha256 checksum of the latest archive. Returns an
+// empty string if the source doesn't support checksums.
+func (s *updateSource) remoteHash() (string, error) {
+	if s.hashURL == "" {
+		return "", nil
+	}
+
+	resp, err := s.get(s.hashURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+
+	// Format is "<sha256>  <filename>".
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 || len(fields[0]) != 64 {
+		return "", fmt.Errorf("invalid checksum response: %q", b)
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
+// hashPath is where the checksum of the archive the database was extracted
+// from is stored, to prevent downloading unchanged databases.
+func (d *DB) hashPath() string {
+	return d.path + ".sha256"
+}
+
+func (d *DB) localHash() string {
+	b, err := os.ReadFile(d.hashPath())
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// autoUpdate checks for database updates every interval, updating the
+// database when necessary. Failed updates are retried with exponential
+// backoff (capped at interval). This blocks, so it should be invoked in a
+// goroutine.
+func (d *DB) autoUpdate(src *updateSource, interval time.Duration) {
+	const minBackoff = 30 * time.Second
+
+	backoff := minBackoff
+
+	for {
+		logger.Println("checking for database updates")
+
+		err := d.checkAndUpdate(src)
+		if err == nil {
+			backoff = minBackoff
+			time.Sleep(interval)
+			continue
+		}
+
+		logger.Printf("error updating database (retrying in %s): %s", backoff, err)
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > interval {
+			backoff = interval
+		}
+	}
+}
+
+func (d *DB) checkAndUpdate(src *updateSource) error {
+	needsUpdate, err := d.checkForUpdates()
+
+	hash, herr := src.remoteHash()
+	if herr != nil {
+		return fmt.Errorf("unable to fetch database checksum: %w", herr)
+	}
+
+	// If we know the checksum of the latest database, there is no need to rely
+	// on the age of the database, as we know exactly if it has changed.
+	if hash != "" && err == nil && d.loaded() {
+		needsUpdate = hash != d.localHash()
+	}
+
+	if !needsUpdate {
+		logger.Println("no database updates needed")
+		return nil
+	}
+
+	if err != nil {
+		logger.Printf("database needs update due to error (%s)", err)
+	} else {
+		logger.Println("database needs update")
+	}
+
+	if err = d.update(src, hash); err != nil {
+		return err
+	}
+
+	if hash != "" {
+		if err = os.WriteFile(d.hashPath(), []byte(hash+"\n"), 0o600); err != nil {
+			logger.Printf("unable to store database checksum: %s", err)
+		}
+	}
+
+	return nil
+}
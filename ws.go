@@ -0,0 +1,156 @@
+// Copyright (c) Liam Stanley <me@liamstanley.io>. All rights reserved. Use
+// of this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteTimeout is the max duration of writing a single message.
+	wsWriteTimeout = 10 * time.Second
+
+	// wsMinPushInterval limits how often a client can trigger a lookup (with
+	// ping frames or messages).
+	wsMinPushInterval = time.Second
+)
+
+// wsConns is the number of currently open websocket connections.
+var wsConns atomic.Int64
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  512,
+	WriteBufferSize: 4096,
+	CheckOrigin:     wsCheckOrigin,
+}
+
+// wsCheckOrigin only allows websocket connections from the --http.cors
+// origins (if the client sent an origin).
+func wsCheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range flags.HTTP.CORS {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apiSelfWebsocket pushes the geolocation of the client (the same as
+// /api/self) over a websocket, as soon as the connection is opened, every
+// --http.ws-interval, and whenever the client sends a ping frame (or any
+// message). Connections are closed after --http.ws-max-lifetime.
+func apiSelfWebsocket(w http.ResponseWriter, r *http.Request) {
+	if n := wsConns.Add(1); n > int64(flags.HTTP.WSMaxConns) {
+		wsConns.Add(-1)
+		errorResponse(w, r, http.StatusServiceUnavailable, errCodeRateLimited, "too many websocket connections, try again later")
+		return
+	}
+	defer wsConns.Add(-1)
+
+	opts := newLookupOptions(w, r)
+	addr := clientIP(r)
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded to the client.
+		logger.Printf("unable to upgrade websocket for %s: %s", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), flags.HTTP.WSMaxLifetime)
+	defer cancel()
+
+	// Reads must happen in the background for control frames (e.g. ping and
+	// close) to be processed. Pings and messages trigger a push.
+	triggers := make(chan struct{}, 1)
+	trigger := func() {
+		select {
+		case triggers <- struct{}{}:
+		default:
+		}
+	}
+
+	conn.SetReadLimit(512)
+	conn.SetPingHandler(func(data string) error {
+		trigger()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(wsWriteTimeout))
+	})
+
+	go func() {
+		defer cancel()
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			trigger()
+		}
+	}()
+
+	push := func() bool {
+		result, _, err := lookupAddr(ctx, addr, opts)
+		if err != nil {
+			result = &AddrResult{Error: "unable to query database"}
+		}
+
+		_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err = conn.WriteJSON(styleFields(result)); err != nil {
+			logger.Printf("error writing websocket message to %s: %s", r.RemoteAddr, err)
+			return false
+		}
+
+		return true
+	}
+
+	ticker := time.NewTicker(flags.HTTP.WSInterval)
+	defer ticker.Stop()
+
+	if !push() {
+		return
+	}
+	last := time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-triggers:
+			// Only pushes triggered by the client are limited, as the
+			// interval itself is at least wsMinPushInterval.
+			if time.Since(last) < wsMinPushInterval {
+				continue
+			}
+		case <-ctx.Done():
+			// Otherwise, the client has gone away.
+			if ctx.Err() != context.DeadlineExceeded {
+				return
+			}
+
+			_ = conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "max connection lifetime reached"),
+				time.Now().Add(wsWriteTimeout),
+			)
+			return
+		}
+
+		if !push() {
+			return
+		}
+		last = time.Now()
+	}
+}